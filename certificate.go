@@ -0,0 +1,155 @@
+package dctoolkit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	_TLS_CERT_VALIDITY = 10 * 365 * 24 * time.Hour
+)
+
+// TlsKeyType contains the key type of the TLS certificate used with peers.
+type TlsKeyType int
+
+const (
+	// TlsKeyRsa2048 generates a 2048-bit RSA key
+	TlsKeyRsa2048 TlsKeyType = iota
+	// TlsKeyEcdsaP256 generates an ECDSA key on the P-256 curve
+	TlsKeyEcdsaP256
+	// TlsKeyRsa4096 generates a 4096-bit RSA key
+	TlsKeyRsa4096
+)
+
+// tlsCertificateGenerate generates a self-signed certificate and its private
+// key, both PEM-encoded.
+func tlsCertificateGenerate(keyType TlsKeyType) ([]byte, []byte, error) {
+	var priv crypto.Signer
+	var err error
+	switch keyType {
+	case TlsKeyRsa2048:
+		priv, err = rsa.GenerateKey(crand.Reader, 2048)
+	case TlsKeyEcdsaP256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	case TlsKeyRsa4096:
+		priv, err = rsa.GenerateKey(crand.Reader, 4096)
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type: %d", keyType)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "dctoolkit"},
+		NotBefore:    now.Add(-1 * time.Hour),
+		NotAfter:     now.Add(_TLS_CERT_VALIDITY),
+		KeyUsage: func() x509.KeyUsage {
+			if keyType == TlsKeyEcdsaP256 {
+				return x509.KeyUsageDigitalSignature
+			}
+			return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		}(),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	bcert, err := x509.CreateCertificate(crand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bkey, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bcert})
+	keyPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: bkey})
+	return certPEMBlock, keyPEMBlock, nil
+}
+
+// tlsCertificateLoad loads the certificate used with peers from disk, or
+// generates it (and saves it, if the file paths are provided).
+func tlsCertificateLoad(conf ClientConf) (tls.Certificate, error) {
+	if (conf.TlsCertFile == "") != (conf.TlsKeyFile == "") {
+		return tls.Certificate{}, fmt.Errorf("tls cert file and tls key file must be both set")
+	}
+
+	certPEMBlock, keyPEMBlock, err := func() ([]byte, []byte, error) {
+		if conf.TlsCertFile != "" {
+			_, certErr := os.Stat(conf.TlsCertFile)
+			_, keyErr := os.Stat(conf.TlsKeyFile)
+
+			// both files exist: load them
+			if certErr == nil && keyErr == nil {
+				certPEMBlock, err := ioutil.ReadFile(conf.TlsCertFile)
+				if err != nil {
+					return nil, nil, err
+				}
+				keyPEMBlock, err := ioutil.ReadFile(conf.TlsKeyFile)
+				if err != nil {
+					return nil, nil, err
+				}
+				dolog(LevelDebug, "[tls] certificate loaded from %s", conf.TlsCertFile)
+				return certPEMBlock, keyPEMBlock, nil
+			}
+
+			// only one of the files exist: do not overwrite it
+			if os.IsNotExist(certErr) == false || os.IsNotExist(keyErr) == false {
+				return nil, nil, fmt.Errorf("tls cert file and tls key file must both exist or not exist")
+			}
+		}
+
+		certPEMBlock, keyPEMBlock, err := tlsCertificateGenerate(conf.TlsKeyType)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if conf.TlsCertFile != "" {
+			if err := ioutil.WriteFile(conf.TlsKeyFile, keyPEMBlock, 0600); err != nil {
+				return nil, nil, err
+			}
+			if err := ioutil.WriteFile(conf.TlsCertFile, certPEMBlock, 0644); err != nil {
+				return nil, nil, err
+			}
+			dolog(LevelInfo, "[tls] certificate generated and saved in %s", conf.TlsCertFile)
+		}
+		return certPEMBlock, keyPEMBlock, nil
+	}()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tcert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tcert.Leaf, err = x509.ParseCertificate(tcert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if time.Now().After(tcert.Leaf.NotAfter) {
+		return tls.Certificate{}, fmt.Errorf("tls certificate has expired")
+	}
+
+	return tcert, nil
+}
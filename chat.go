@@ -1,5 +1,22 @@
 package dctoolkit
 
+import (
+	"time"
+)
+
+const (
+	// time after which a direct connection request is considered failed, and
+	// queued messages are routed through the hub
+	_CCPM_REQUEST_TIMEOUT = 10 * time.Second
+)
+
+type ccpmRequest struct {
+	peer  *Peer
+	timer *time.Timer
+	// messages that are sent when the connection is established
+	messages []string
+}
+
 // MessagePublic publishes a message in the hub public chat.
 func (c *Client) MessagePublic(content string) {
 	if c.protoIsAdc == true {
@@ -13,17 +30,127 @@ func (c *Client) MessagePublic(content string) {
 	}
 }
 
+// PrivateMessageRoute contains the route used to send a private message.
+type PrivateMessageRoute int
+
+const (
+	// PrivateMessageHub means that the message has been routed through the hub
+	PrivateMessageHub PrivateMessageRoute = iota
+	// PrivateMessageDirect means that the message has been sent through an
+	// encrypted direct connection with the peer (CCPM), that the hub cannot read
+	PrivateMessageDirect
+	// PrivateMessagePending means that the message has been queued while the
+	// direct connection is being established. The route is reported later
+	// through OnMessagePrivateSent
+	PrivateMessagePending
+)
+
 // MessagePrivate sends a private message to a specific peer connected to the hub.
-func (c *Client) MessagePrivate(dest *Peer, content string) {
+// In ADC, if the peer supports CCPM, the message is sent through an encrypted
+// direct connection. If the connection is not available yet, it is opened and
+// the message is queued until it is established; if the connection fails or
+// is not established in time, queued messages are routed through the hub.
+// The returned value contains the route used, or PrivateMessagePending.
+func (c *Client) MessagePrivate(dest *Peer, content string) PrivateMessageRoute {
 	if c.protoIsAdc == true {
-		c.connHub.conn.Write(&msgAdcDMessage{
-			msgAdcTypeD{c.sessionId, dest.adcSessionId},
-			msgAdcKeyMessage{Content: content},
-		})
+		if pconn, ok := c.connPeersByKey[nickDirectionPair{dest.Nick, "chat"}]; ok {
+			pconn.conn.Write(&msgAdcCMessage{
+				msgAdcTypeC{},
+				msgAdcKeyMessage{Content: content},
+			})
+			return PrivateMessageDirect
+		}
+
+		if c.peerSupportsCcpm(dest) {
+			c.ccpmQueueMessage(dest, content)
+			return PrivateMessagePending
+		}
+
+		c.messagePrivateHub(dest, content)
 
 	} else {
 		c.connHub.conn.Write(&msgNmdcPrivateChat{c.conf.Nick, dest.Nick, content})
 	}
+	return PrivateMessageHub
+}
+
+func (c *Client) messagePrivateHub(dest *Peer, content string) {
+	c.connHub.conn.Write(&msgAdcDMessage{
+		msgAdcTypeD{c.sessionId, dest.adcSessionId},
+		msgAdcKeyMessage{Content: content},
+	})
+}
+
+func (c *Client) peerSupportsCcpm(p *Peer) bool {
+	if c.conf.PeerDisableCcpm == true || c.conf.PeerEncryptionMode == DisableEncryption {
+		return false
+	}
+	if _, ok := p.adcSupports[adcSupportCcpm]; !ok {
+		return false
+	}
+	return c.peerSupportsEncryption(p)
+}
+
+// ccpmQueueMessage queues a message until the direct connection with a peer
+// is established, and requests the connection if it has not been requested yet.
+func (c *Client) ccpmQueueMessage(peer *Peer, content string) {
+	for _, req := range c.ccpmRequests {
+		if req.peer == peer {
+			req.messages = append(req.messages, content)
+			return
+		}
+	}
+
+	token := adcRandomToken()
+	c.ccpmRequests[token] = &ccpmRequest{
+		peer: peer,
+		timer: time.AfterFunc(_CCPM_REQUEST_TIMEOUT, func() {
+			c.Safe(func() {
+				if _, ok := c.ccpmRequests[token]; ok {
+					dolog(LevelInfo, "[peer] [%s] chat connection timed out", peer.Nick)
+					c.ccpmRequestDone(token)
+				}
+			})
+		}),
+		messages: []string{content},
+	}
+	dolog(LevelInfo, "[peer] [%s] requesting chat connection", peer.Nick)
+	c.peerRequestConnection(peer, token)
+}
+
+// ccpmRequestDone sends the messages queued by a request, through the direct
+// connection if it has been established, otherwise through the hub.
+func (c *Client) ccpmRequestDone(token string) {
+	req := c.ccpmRequests[token]
+	delete(c.ccpmRequests, token)
+	req.timer.Stop()
+
+	pconn := c.connPeersByKey[nickDirectionPair{req.peer.Nick, "chat"}]
+	for _, content := range req.messages {
+		route := PrivateMessageHub
+		if pconn != nil {
+			pconn.conn.Write(&msgAdcCMessage{
+				msgAdcTypeC{},
+				msgAdcKeyMessage{Content: content},
+			})
+			route = PrivateMessageDirect
+		} else {
+			c.messagePrivateHub(req.peer, content)
+		}
+		if c.OnMessagePrivateSent != nil {
+			c.OnMessagePrivateSent(req.peer, content, route)
+		}
+	}
+}
+
+// ccpmConnectionEstablished sends the messages queued for the peer of a chat
+// connection, even if the connection has been opened by the peer.
+func (c *Client) ccpmConnectionEstablished(pconn *connPeer) {
+	for token, req := range c.ccpmRequests {
+		if req.peer == pconn.peer {
+			c.ccpmRequestDone(token)
+		}
+	}
 }
 
 func (c *Client) handlePublicMessage(author *Peer, content string) {
@@ -33,9 +160,14 @@ func (c *Client) handlePublicMessage(author *Peer, content string) {
 	}
 }
 
-func (c *Client) handlePrivateMessage(author *Peer, content string) {
-	dolog(LevelInfo, "[PRIV] <%s> %s", author.Nick, content)
+func (c *Client) handlePrivateMessage(author *Peer, content string, endToEnd bool) {
+	dolog(LevelInfo, "[PRIV%s] <%s> %s", func() string {
+		if endToEnd == true {
+			return " E2E"
+		}
+		return ""
+	}(), author.Nick, content)
 	if c.OnMessagePrivate != nil {
-		c.OnMessagePrivate(author, content)
+		c.OnMessagePrivate(author, content, endToEnd)
 	}
 }
@@ -0,0 +1,128 @@
+package dctoolkit
+
+import (
+	"testing"
+)
+
+// testProtocol is a protocol that records written messages.
+type testProtocol struct {
+	protocol
+	written []msgEncodable
+}
+
+func (p *testProtocol) Write(msg msgEncodable) {
+	p.written = append(p.written, msg)
+}
+
+func testCcpmClient() (*Client, *testProtocol, *Peer) {
+	hubConn := &testProtocol{}
+	c := &Client{
+		conf: ClientConf{
+			Nick:               "client",
+			PeerEncryptionMode: PreferEncryption,
+		},
+		protoIsAdc:     true,
+		sessionId:      "AAAA",
+		connHub:        &connHub{conn: hubConn},
+		connPeersByKey: make(map[nickDirectionPair]*connPeer),
+		ccpmRequests:   make(map[string]*ccpmRequest),
+	}
+	peer := &Peer{
+		Nick:         "peer",
+		adcSessionId: "BBBB",
+		adcSupports: map[string]struct{}{
+			adcSupportTls:  {},
+			adcSupportCcpm: {},
+		},
+	}
+	return c, hubConn, peer
+}
+
+func TestMessagePrivateCcpm(t *testing.T) {
+	countHubMessages := func(conn *testProtocol) (int, int) {
+		requests, messages := 0, 0
+		for _, msg := range conn.written {
+			switch msg.(type) {
+			case *msgAdcDConnectToMe:
+				requests++
+			case *msgAdcDMessage:
+				messages++
+			}
+		}
+		return requests, messages
+	}
+
+	for _, ca := range []struct {
+		name     string
+		finish   func(c *Client, token string)
+		route    PrivateMessageRoute
+		hubCount int
+	}{
+		{
+			"connection established",
+			func(c *Client, token string) {
+				pconn := &connPeer{
+					client: c,
+					conn:   &testProtocol{},
+					peer:   c.ccpmRequests[token].peer,
+				}
+				c.connPeersByKey[nickDirectionPair{"peer", "chat"}] = pconn
+				c.ccpmConnectionEstablished(pconn)
+			},
+			PrivateMessageDirect,
+			0,
+		},
+		{
+			"connection failed",
+			func(c *Client, token string) {
+				c.ccpmRequestDone(token)
+			},
+			PrivateMessageHub,
+			2,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			c, hubConn, peer := testCcpmClient()
+			var sent []PrivateMessageRoute
+			c.OnMessagePrivateSent = func(p *Peer, content string, route PrivateMessageRoute) {
+				sent = append(sent, route)
+			}
+
+			for _, content := range []string{"first", "second"} {
+				if route := c.MessagePrivate(peer, content); route != PrivateMessagePending {
+					t.Fatalf("unexpected route: %v", route)
+				}
+			}
+
+			// messages are not routed through the hub while the connection is pending
+			requests, messages := countHubMessages(hubConn)
+			if requests != 1 || messages != 0 {
+				t.Fatalf("expected 1 request and no messages, got %d and %d", requests, messages)
+			}
+			if len(c.ccpmRequests) != 1 || len(sent) != 0 {
+				t.Fatal("messages have not been queued")
+			}
+
+			var token string
+			for tok := range c.ccpmRequests {
+				token = tok
+			}
+			ca.finish(c, token)
+
+			if _, messages := countHubMessages(hubConn); messages != ca.hubCount {
+				t.Errorf("expected %d messages through the hub, got %d", ca.hubCount, messages)
+			}
+			if len(sent) != 2 || sent[0] != ca.route || sent[1] != ca.route {
+				t.Errorf("unexpected routes: %v", sent)
+			}
+			if len(c.ccpmRequests) != 0 {
+				t.Errorf("request has not been removed")
+			}
+			if pconn, ok := c.connPeersByKey[nickDirectionPair{"peer", "chat"}]; ok {
+				if n := len(pconn.conn.(*testProtocol).written); n != 2 {
+					t.Errorf("expected 2 direct messages, got %d", n)
+				}
+			}
+		})
+	}
+}
@@ -35,6 +35,7 @@ Basic example (more are available at https://github.com/gswly/dctoolkit/tree/mas
 package dctoolkit
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -89,8 +90,66 @@ type ClientConf struct {
 	DownloadMaxParallel uint
 	// the maximum number of file to upload in parallel
 	UploadMaxParallel uint
+	// the path of a file in which the TTHs and leaves of shared files are stored,
+	// in order to avoid computing them again after a restart. It is compacted
+	// automatically when most of its entries are dead. If empty, TTHs are
+	// computed at every start
+	HashDatabasePath string
+	// the number of files hashed in parallel. It defaults to 2
+	HashWorkers uint
+	// the maximum speed at which shared files are read from disk while
+	// hashing, in bytes/sec. If zero, the speed is not limited
+	HashMaxSpeed uint
+	// how often shared directories are scanned in order to detect changed files.
+	// Only changed files are hashed, and the share is published again only if
+	// something has changed. If zero, directories are scanned only when ShareAdd
+	// or ShareDel are called
+	ShareRescanInterval time.Duration
+	// whether to watch shared directories for changes (Linux only). Changed
+	// directories are scanned again as soon as changes settle
+	ShareWatch bool
+	// the minimum interval between two outgoing searches, since hubs kick or
+	// ban clients that search too often. Searches are queued and sent in
+	// priority order. It defaults to 10 seconds
+	SearchMinInterval time.Duration
+	// the maximum number of incoming searches answered per minute for every
+	// source (IP, nick or session). It defaults to 30
+	SearchIncomingMaxPerSource uint
+	// the maximum number of incoming searches answered per second, from any
+	// source. It defaults to 50
+	SearchIncomingMaxTotal uint
+	// active NMDC searches contain the ip to which results are sent, and are
+	// answered only if the ip belongs to a peer. This check is possible only
+	// if the hub sends the ips of peers ($UserIP), that usually happens only
+	// for operators. When ips are unknown, active searches are answered by
+	// default; if this is true, they are ignored
+	SearchIncomingIgnoreUnverifiedIps bool
+	// rules that exclude files and directories from every shared directory.
+	// See ShareExclusion for the available options
+	ShareExclusion ShareExclusion
+	// an optional policy that decides whether an upload request can be served.
+	// See UploadPolicy and UploadRulePolicy
+	UploadPolicy UploadPolicy
 	// set the policy regarding encryption with other peers. See EncryptionMode for options
 	PeerEncryptionMode EncryptionMode
+	// the files in which the TLS certificate and private key used with peers are
+	// stored, in PEM format. If they do not exist, they are generated and saved.
+	// If they are not set, a new certificate is generated at every start, and
+	// therefore the ADC keyprint changes
+	TlsCertFile string
+	TlsKeyFile  string
+	// the key type used when generating the TLS certificate. See TlsKeyType for options
+	TlsKeyType TlsKeyType
+	// an optional store that remembers the keyprints of peers, in order to detect
+	// certificate changes. See MemoryTrustStore and FileTrustStore
+	PeerTrustStore TrustStore
+	// refuse peers that do not provide a certificate, or whose keyprint does not
+	// match the one advertised by the hub or the one in the trust store.
+	// It requires PeerEncryptionMode to be ForceEncryption
+	PeerStrictKeyprint bool
+	// disable encrypted direct private messages (CCPM) and route all private
+	// messages through the hub
+	PeerDisableCcpm bool
 	// The hub url in the format protocol://address:port
 	// supported protocols are adc, adcs, nmdc and nmdcs
 	HubUrl string
@@ -135,11 +194,15 @@ type Client struct {
 	hubSolvedIp        string
 	ip                 string
 	shareIndexer       *shareIndexer
-	shareRoots         map[string]string
+	shareRoots         map[string]*shareRoot
 	shareTree          map[string]*shareDirectory
+	shareIndex         *shareIndex
+	shareIndexReport   ShareIndexReport
+	hashDatabase       *hashDatabase
 	shareCount         uint
 	shareSize          uint64
-	fileList           []byte
+	fileLists          map[string][]byte
+	friends            map[string]struct{}
 	listenerTcp        *listenerTcp
 	tcpTlsListener     *listenerTcp
 	listenerUdp        *listenerUdp
@@ -148,19 +211,35 @@ type Client struct {
 	privateId             []byte
 	clientId              []byte
 	sessionId             string // we save it encoded since it is 20 bits and cannot be decoded easily
+	tlsCert               tls.Certificate
 	adcFingerprint        string
 	peers                 map[string]*Peer
+	hubSendsPeerIps       bool
 	downloadSlotAvail     uint
 	uploadSlotAvail       uint
 	connPeers             map[*connPeer]struct{}
 	connPeersByKey        map[nickDirectionPair]*connPeer
 	transfers             map[transfer]struct{}
 	activeDownloadsByPeer map[string]*Download
+	ccpmRequests          map[string]*ccpmRequest
+	searchSessions        map[*SearchSession]struct{}
+	searchQueue           []*searchQueueEntry
+	searchLastSent        time.Time
+	searchTimer           *time.Timer
+	searchLimiter         *searchLimiter
+	udpSender             net.PacketConn
 
 	// called just after client initialization, before connecting to the hub
 	OnInitialized func()
 	// called every time the share indexer has finished indexing the client share
 	OnShareIndexed func()
+	// called at the end of every indexing for each file or directory that
+	// could not be indexed. The other files are indexed anyway
+	OnShareIndexError func(path string, err error)
+	// called periodically while shared files are being hashed, and every time
+	// a file has been hashed. done and total are the hashed and the total bytes
+	// of the current indexing
+	OnHashProgress func(file string, done uint64, total uint64, bytesPerSec uint64)
 	// called when the connection between client and hub has been established
 	OnHubConnected func()
 	// called when a critical error happens
@@ -171,16 +250,32 @@ type Client struct {
 	OnPeerUpdated func(p *Peer)
 	// called when a peer disconnects from the hub
 	OnPeerDisconnected func(p *Peer)
+	// called when the keyprint of a peer differs from the one in the trust store
+	OnPeerKeyprintChanged func(p *Peer, oldKeyprint string, newKeyprint string)
 	// called when someone has written in the hub public chat
 	OnMessagePublic func(p *Peer, content string)
-	// called when a private message has been received
-	OnMessagePrivate func(p *Peer, content string)
+	// called when a private message has been received. endToEnd is true when
+	// the message has been received through an encrypted direct connection (CCPM)
+	OnMessagePrivate func(p *Peer, content string, endToEnd bool)
+	// called when a private message that has been queued by MessagePrivate,
+	// while the direct connection was being established, has been sent
+	// through the given route
+	OnMessagePrivateSent func(p *Peer, content string, route PrivateMessageRoute)
 	// called when a search result has been received
 	OnSearchResult func(r *SearchResult)
+	// called when a valid search request has been received from a peer, before
+	// the share is searched. Requests that are not answered because of rate
+	// limits or unverified ips are reported too, with SearchRequest.Answered
+	// set to false. Results can be added to the reply with SearchRequest.AddResult
+	OnSearchRequest func(r *SearchRequest)
 	// called when a given download has finished
 	OnDownloadSuccessful func(d *Download)
 	// called when a given download has failed
 	OnDownloadError func(d *Download)
+	// called when a given download has failed and is going to be retried
+	OnDownloadRetry func(d *Download)
+	// called when all the files of a directory download have been processed
+	OnDirectoryDownloadFinished func(dd *DirectoryDownload)
 }
 
 // NewClient is used to initialize a client. See ClientConf for the available options.
@@ -199,12 +294,27 @@ func NewClient(conf ClientConf) (*Client, error) {
 	if conf.TcpPort != 0 && conf.TcpPort == conf.TcpTlsPort {
 		return nil, fmt.Errorf("tcp port and tcp tls port cannot be the same")
 	}
+	if conf.PeerStrictKeyprint == true && conf.PeerEncryptionMode != ForceEncryption {
+		return nil, fmt.Errorf("strict keyprint validation requires encryption to be forced")
+	}
 	if conf.DownloadMaxParallel == 0 {
 		conf.DownloadMaxParallel = 6
 	}
 	if conf.UploadMaxParallel == 0 {
 		conf.UploadMaxParallel = 10
 	}
+	if conf.HashWorkers == 0 {
+		conf.HashWorkers = 2
+	}
+	if conf.SearchMinInterval == 0 {
+		conf.SearchMinInterval = 10 * time.Second
+	}
+	if conf.SearchIncomingMaxPerSource == 0 {
+		conf.SearchIncomingMaxPerSource = 30
+	}
+	if conf.SearchIncomingMaxTotal == 0 {
+		conf.SearchIncomingMaxTotal = 50
+	}
 	if conf.HubConnTries == 0 {
 		conf.HubConnTries = 3
 	}
@@ -257,8 +367,11 @@ func NewClient(conf ClientConf) (*Client, error) {
 		hubIsEncrypted:        (u.Scheme == "adcs" || u.Scheme == "nmdcs"),
 		hubHostname:           u.Hostname(),
 		hubPort:               atoui(u.Port()),
-		shareRoots:            make(map[string]string),
+		shareRoots:            make(map[string]*shareRoot),
+		fileLists:             make(map[string][]byte),
+		friends:               make(map[string]struct{}),
 		shareTree:             make(map[string]*shareDirectory),
+		shareIndex:            newShareIndex(nil),
 		peers:                 make(map[string]*Peer),
 		downloadSlotAvail:     conf.DownloadMaxParallel,
 		uploadSlotAvail:       conf.UploadMaxParallel,
@@ -266,6 +379,8 @@ func NewClient(conf ClientConf) (*Client, error) {
 		connPeersByKey:        make(map[nickDirectionPair]*connPeer),
 		transfers:             make(map[transfer]struct{}),
 		activeDownloadsByPeer: make(map[string]*Download),
+		ccpmRequests:          make(map[string]*ccpmRequest),
+		searchSessions:        make(map[*SearchSession]struct{}),
 	}
 
 	// generate privateId (random)
@@ -277,6 +392,18 @@ func NewClient(conf ClientConf) (*Client, error) {
 	hasher.Write(c.privateId)
 	c.clientId = hasher.Sum(nil)
 
+	if c.conf.PeerEncryptionMode != DisableEncryption {
+		c.tlsCert, err = tlsCertificateLoad(c.conf)
+		if err != nil {
+			return nil, err
+		}
+		if c.protoIsAdc == true {
+			c.adcFingerprint = adcCertificateFingerprint(c.tlsCert.Leaf)
+		}
+	}
+
+	c.searchLimiter = newSearchLimiter(c)
+
 	if err := newConnHub(c); err != nil {
 		return nil, err
 	}
@@ -359,6 +486,12 @@ func (c *Client) Run() {
 	<-c.terminate
 
 	c.Safe(func() {
+		if c.searchTimer != nil {
+			c.searchTimer.Stop()
+		}
+		for _, req := range c.ccpmRequests {
+			req.timer.Stop()
+		}
 		c.connHub.close()
 		for t := range c.transfers {
 			t.Close()
@@ -376,9 +509,16 @@ func (c *Client) Run() {
 			c.listenerTcp.close()
 		}
 		c.shareIndexer.close()
+		if c.udpSender != nil {
+			c.udpSender.Close()
+		}
 	})
 
 	c.wg.Wait()
+
+	if c.hashDatabase != nil {
+		c.hashDatabase.close()
+	}
 }
 
 func (c *Client) dlPublicIp() error {
@@ -434,12 +574,15 @@ func (c *Client) sendInfos(firstTime bool) {
 	}
 
 	if c.protoIsAdc == true {
-		supports := []string{adcSupport0}
+		supports := []string{adcSupport0, adcSupportFileExtensionGrouping}
 		if c.conf.IsPassive == false {
-			supports = append(supports, adcSupportTcp4, adcSupportUdp4)
+			supports = append(supports, adcSupportTcp4, adcSupportUdp4, adcSupportSudp)
 		}
 		if c.conf.PeerEncryptionMode != DisableEncryption {
 			supports = append(supports, adcSupportTls)
+			if c.conf.PeerDisableCcpm == false {
+				supports = append(supports, adcSupportCcpm)
+			}
 		}
 
 		fields := map[string]string{
@@ -57,6 +57,7 @@ func main() {
 	}
 
 	filelistDownloaded := false
+	dirDownload := false
 	client.OnDownloadSuccessful = func(d *dctk.Download) {
 		if filelistDownloaded == false {
 			filelistDownloaded = true
@@ -76,18 +77,24 @@ func main() {
 			// check if it is a directory
 			dir, err := fl.GetDirectory(*fpath)
 			if err == nil {
-				client.DownloadFLDirectory(d.Conf().Peer, dir, filepath.Join(*outdir, dir.Name))
+				_, err := client.DownloadFLDirectory(d.Conf().Peer, dir, filepath.Join(*outdir, dir.Name))
+				if err != nil {
+					panic(err)
+				}
+				dirDownload = true
 				return
 			}
 
 			panic("file or directory not found")
 
-		} else {
-			if client.DownloadCount() == 0 {
-				client.Close()
-			}
+		} else if dirDownload == false {
+			client.Close()
 		}
 	}
 
+	client.OnDirectoryDownloadFinished = func(dd *dctk.DirectoryDownload) {
+		client.Close()
+	}
+
 	client.Run()
 }
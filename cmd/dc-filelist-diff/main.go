@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	dctk "github.com/gswly/dctoolkit"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	summaryOnly = kingpin.Flag("summary", "Print only the summary").Bool()
+	oldPath     = kingpin.Arg("old", "Path to the old file list (files.xml or files.xml.bz2)").Required().String()
+	newPath     = kingpin.Arg("new", "Path to the new file list (files.xml or files.xml.bz2)").Required().String()
+)
+
+func main() {
+	kingpin.CommandLine.Help = "Print the differences between two versions of a file list."
+	kingpin.Parse()
+
+	ch, err := dctk.FileListDiffFiles(*oldPath, *newPath)
+	if err != nil {
+		panic(err)
+	}
+
+	if *summaryOnly == false {
+		for _, c := range ch.Added {
+			fmt.Printf("+ %s\n", c.NewPath)
+		}
+		for _, c := range ch.Removed {
+			fmt.Printf("- %s\n", c.OldPath)
+		}
+		for _, c := range ch.Modified {
+			fmt.Printf("M %s\n", c.NewPath)
+		}
+		for _, c := range ch.Moved {
+			fmt.Printf("R %s -> %s\n", c.OldPath, c.NewPath)
+		}
+	}
+
+	fmt.Println(ch.Summary)
+}
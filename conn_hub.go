@@ -329,7 +329,7 @@ func (h *connHub) handleMessage(msgi msgDecodable) error {
 		if p == nil {
 			return fmt.Errorf("private message with unknown author")
 		}
-		h.client.handlePrivateMessage(p, msg.Content)
+		h.client.handlePrivateMessage(p, msg.Content, false)
 
 	case *msgAdcBSearchRequest:
 		h.client.handleAdcSearchIncomingRequest(msg.SessionId, &msg.msgAdcKeySearchRequest)
@@ -555,6 +555,12 @@ func (h *connHub) handleMessage(msgi msgDecodable) error {
 		// we do not use UserIp to get our own ip, but only to get other
 		// ips of other peers
 		for peer, ip := range msg.Ips {
+			// hubs send our own ip to everyone, other ips are sent only when
+			// they can be used to verify incoming searches
+			if peer != h.client.conf.Nick {
+				h.client.hubSendsPeerIps = true
+			}
+
 			// update peer
 			p := h.client.peerByNick(peer)
 			if p != nil {
@@ -662,7 +668,7 @@ func (h *connHub) handleMessage(msgi msgDecodable) error {
 		if p == nil { // create a dummy peer if not found
 			p = &Peer{Nick: msg.Author}
 		}
-		h.client.handlePrivateMessage(p, msg.Content)
+		h.client.handlePrivateMessage(p, msg.Content, false)
 
 	default:
 		return fmt.Errorf("unhandled: %T %+v", msgi, msgi)
@@ -675,4 +681,7 @@ func (h *connHub) handleHubInitialized() {
 	if h.client.OnHubConnected != nil {
 		h.client.OnHubConnected()
 	}
+
+	// send searches queued before the connection
+	h.client.searchQueueProcess()
 }
@@ -26,9 +26,11 @@ type connPeer struct {
 	tlsConn            *tls.Conn
 	adcToken           string
 	passiveIp          string
+	remoteIp           string
 	passivePort        uint
 	peer               *Peer
 	remoteLock         []byte
+	remoteFeatures     map[string]struct{}
 	localDirection     string
 	localBet           uint
 	remoteDirection    string
@@ -56,6 +58,7 @@ func newConnPeer(client *Client, isEncrypted bool, isActive bool,
 			return ""
 		}())
 		p.state = "connected"
+		p.remoteIp, _, _ = net.SplitHostPort(rawconn.RemoteAddr().String())
 		if p.isEncrypted == true {
 			p.tlsConn = rawconn.(*tls.Conn)
 		}
@@ -73,6 +76,7 @@ func newConnPeer(client *Client, isEncrypted bool, isActive bool,
 		}())
 		p.state = "connecting"
 		p.passiveIp = ip
+		p.remoteIp = ip
 		p.passivePort = port
 	}
 
@@ -117,7 +121,10 @@ func (p *connPeer) do() {
 
 			rawconn := ce.Conn
 			if p.isEncrypted == true {
-				p.tlsConn = tls.Client(rawconn, &tls.Config{InsecureSkipVerify: true})
+				p.tlsConn = tls.Client(rawconn, &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       []tls.Certificate{p.client.tlsCert},
+				})
 				rawconn = p.tlsConn
 			}
 
@@ -127,8 +134,12 @@ func (p *connPeer) do() {
 				p.conn = newProtocolNmdc("p", rawconn, true, true)
 			}
 
+			var features map[string]struct{}
 			p.client.Safe(func() {
 				p.state = "connected"
+				if p.client.protoIsAdc == true {
+					features = p.adcLocalFeatures()
+				}
 			})
 
 			dolog(LevelInfo, "[peer] connected %s%s", rawconn.RemoteAddr(),
@@ -143,13 +154,7 @@ func (p *connPeer) do() {
 			if p.client.protoIsAdc == true {
 				p.conn.Write(&msgAdcCSupports{
 					msgAdcTypeC{},
-					msgAdcKeySupports{map[string]struct{}{
-						adcFeatureBas0:         {},
-						adcFeatureBase:         {},
-						adcFeatureTiger:        {},
-						adcFeatureFileListBzip: {},
-						adcFeatureZlibGet:      {},
-					}},
+					msgAdcKeySupports{features},
 				})
 
 			} else {
@@ -232,8 +237,8 @@ func (p *connPeer) do() {
 
 		if p.terminateRequested == false {
 			switch p.state {
-			// timeout while waiting, not an error
-			case "wait_upload", "wait_download":
+			// timeout while waiting or chat closed, not an error
+			case "wait_upload", "wait_download", "chat", "chat_closed":
 			default:
 				if p.terminateRequested == false {
 					dolog(LevelInfo, "ERR (connPeer): %s", err)
@@ -251,6 +256,13 @@ func (p *connPeer) do() {
 			delete(p.client.connPeersByKey, nickDirectionPair{p.peer.Nick, p.direction})
 		}
 
+		// the connection requested to send private messages has failed
+		if p.state != "chat" && p.state != "chat_closed" {
+			if _, ok := p.client.ccpmRequests[p.adcToken]; ok {
+				p.client.ccpmRequestDone(p.adcToken)
+			}
+		}
+
 		dolog(LevelInfo, "[peer] disconnected")
 	})
 }
@@ -267,16 +279,11 @@ func (p *connPeer) handleMessage(msgi msgDecodable) error {
 			return fmt.Errorf("[Supports] invalid state: %s", p.state)
 		}
 		p.state = "supports"
+		p.remoteFeatures = msg.Features
 		if p.isActive == true {
 			p.conn.Write(&msgAdcCSupports{
 				msgAdcTypeC{},
-				msgAdcKeySupports{map[string]struct{}{
-					adcFeatureBas0:         {},
-					adcFeatureBase:         {},
-					adcFeatureTiger:        {},
-					adcFeatureFileListBzip: {},
-					adcFeatureZlibGet:      {},
-				}},
+				msgAdcKeySupports{p.adcLocalFeatures()},
 			})
 
 		} else {
@@ -305,6 +312,12 @@ func (p *connPeer) handleMessage(msgi msgDecodable) error {
 			return fmt.Errorf("unknown client id (%s)", clientId)
 		}
 
+		if p.isEncrypted == true {
+			if err := p.validateKeyprint(); err != nil {
+				return err
+			}
+		}
+
 		if p.isActive == true {
 			token, ok := msg.Fields[adcFieldToken]
 			if ok == false {
@@ -319,22 +332,22 @@ func (p *connPeer) handleMessage(msgi msgDecodable) error {
 					// token is not sent back when in active mode
 				}},
 			})
-		} else {
-			// validate peer fingerprint
-			// can be performed on client-side only since many clients do not send
-			// their certificate when in passive mode
-			if p.client.protoIsAdc == true && p.isEncrypted == true &&
-				p.peer.adcFingerprint != "" {
-
-				connFingerprint := adcCertificateFingerprint(
-					p.tlsConn.ConnectionState().PeerCertificates[0])
-
-				if connFingerprint != p.peer.adcFingerprint {
-					return fmt.Errorf("unable to validate peer fingerprint (%s vs %s)",
-						connFingerprint, p.peer.adcFingerprint)
-				}
-				dolog(LevelInfo, "[peer] fingerprint validated")
+		}
+
+		if p.isChatRequest() == true {
+			key := nickDirectionPair{p.peer.Nick, "chat"}
+			if _, ok := p.client.connPeersByKey[key]; ok {
+				return fmt.Errorf("a connection with this peer and direction already exists")
 			}
+			p.client.connPeersByKey[key] = p
+
+			p.direction = "chat"
+			p.state = "chat"
+			// chat connections are idle most of the time
+			p.conn.DisableReadTimeout()
+			dolog(LevelInfo, "[peer] [%s] chat connection established", p.peer.Nick)
+			p.client.ccpmConnectionEstablished(p)
+			return nil
 		}
 
 		dl := p.client.downloadByAdcToken(p.adcToken)
@@ -367,11 +380,27 @@ func (p *connPeer) handleMessage(msgi msgDecodable) error {
 		if p.state != "wait_upload" {
 			return fmt.Errorf("[AdcGet] invalid state: %s", p.state)
 		}
-		ok := newUpload(p.client, p, msg.Query, msg.Start, msg.Length, msg.Compressed)
+		ok := newUpload(p.client, p, msg.Query, msg.Start, msg.Length, msg.Compressed,
+			uploadMethodAdcGet)
 		if ok {
 			return errorDelegatedUpload
 		}
 
+	case *msgAdcCMessage:
+		if p.state != "chat" {
+			return fmt.Errorf("[Message] invalid state: %s", p.state)
+		}
+		p.client.handlePrivateMessage(p.peer, msg.Content, true)
+
+	case *msgAdcCPrivateMessageInfos:
+		if p.state != "chat" {
+			return fmt.Errorf("[PrivateMessageInfos] invalid state: %s", p.state)
+		}
+		if msg.Fields[adcFieldPmQuit] == "1" {
+			p.state = "chat_closed"
+			return fmt.Errorf("chat closed by peer")
+		}
+
 	case *msgNmdcMyNick:
 		if p.state != "connected" {
 			return fmt.Errorf("[MyNick] invalid state: %s", p.state)
@@ -382,6 +411,12 @@ func (p *connPeer) handleMessage(msgi msgDecodable) error {
 			return fmt.Errorf("peer not connected to hub (%s)", msg.Nick)
 		}
 
+		if p.isEncrypted == true {
+			if err := p.validateKeyprint(); err != nil {
+				return err
+			}
+		}
+
 	case *msgNmdcLock:
 		if p.state != "mynick" {
 			return fmt.Errorf("[Lock] invalid state: %s", p.state)
@@ -435,6 +470,7 @@ func (p *connPeer) handleMessage(msgi msgDecodable) error {
 			return fmt.Errorf("[Supports] invalid state: %s", p.state)
 		}
 		p.state = "supports"
+		p.remoteFeatures = msg.Features
 
 	case *msgNmdcDirection:
 		if p.state != "supports" {
@@ -509,13 +545,122 @@ func (p *connPeer) handleMessage(msgi msgDecodable) error {
 		if p.state != "wait_upload" {
 			return fmt.Errorf("[AdcGet] invalid state: %s", p.state)
 		}
-		ok := newUpload(p.client, p, msg.Query, msg.Start, msg.Length, msg.Compressed)
+		ok := newUpload(p.client, p, msg.Query, msg.Start, msg.Length, msg.Compressed,
+			uploadMethodAdcGet)
+		if ok {
+			return errorDelegatedUpload
+		}
+
+	case *msgNmdcUGetBlock:
+		if p.state != "wait_upload" {
+			return fmt.Errorf("[UGetBlock] invalid state: %s", p.state)
+		}
+		ok := newUpload(p.client, p, nmdcLegacyQuery(msg.Path), msg.Start, msg.Length, false,
+			uploadMethodUGetBlock)
 		if ok {
 			return errorDelegatedUpload
 		}
 
+	case *msgNmdcGet:
+		if p.state != "wait_upload" {
+			return fmt.Errorf("[Get] invalid state: %s", p.state)
+		}
+		if msg.Offset == 0 {
+			return fmt.Errorf("[Get] invalid offset")
+		}
+		// content is sent after receiving $Send
+		newUpload(p.client, p, nmdcLegacyQuery(msg.Path), msg.Offset-1, -1, false,
+			uploadMethodGet)
+
+	case *msgNmdcSend:
+		if p.state != "delegated_upload" {
+			return fmt.Errorf("[Send] invalid state: %s", p.state)
+		}
+		return errorDelegatedUpload
+
 	default:
 		return fmt.Errorf("unhandled: %T %+v", msgi, msgi)
 	}
 	return nil
 }
+
+func (p *connPeer) adcLocalFeatures() map[string]struct{} {
+	features := map[string]struct{}{
+		adcFeatureBas0:         {},
+		adcFeatureBase:         {},
+		adcFeatureTiger:        {},
+		adcFeatureFileListBzip: {},
+		adcFeatureZlibGet:      {},
+	}
+	if p.isChatRequest() == true {
+		features[adcFeatureCcpm] = struct{}{}
+	}
+	return features
+}
+
+// isChatRequest returns whether the connection is meant to exchange private
+// messages (CCPM). This happens when the peer advertises the CCPM feature, or
+// when the connection token matches one of our requests.
+func (p *connPeer) isChatRequest() bool {
+	if p.isEncrypted == false || p.client.conf.PeerDisableCcpm == true {
+		return false
+	}
+	if _, ok := p.remoteFeatures[adcFeatureCcpm]; ok {
+		return true
+	}
+	_, ok := p.client.ccpmRequests[p.adcToken]
+	return ok
+}
+
+// validateKeyprint checks the certificate of an encrypted connection against
+// the keyprint advertised by the hub and the one stored in the trust store.
+func (p *connPeer) validateKeyprint() error {
+	strict := (p.client.conf.PeerEncryptionMode == ForceEncryption &&
+		p.client.conf.PeerStrictKeyprint == true)
+
+	certs := p.tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		// many clients do not send their certificate when in passive mode
+		if strict == true {
+			return fmt.Errorf("peer did not provide a certificate")
+		}
+		return nil
+	}
+	connFingerprint := adcCertificateFingerprint(certs[0])
+
+	if p.client.protoIsAdc == true && p.peer.adcFingerprint != "" {
+		if connFingerprint != p.peer.adcFingerprint {
+			return fmt.Errorf("unable to validate peer fingerprint (%s vs %s)",
+				connFingerprint, p.peer.adcFingerprint)
+		}
+		dolog(LevelInfo, "[peer] fingerprint validated")
+
+	} else if strict == true && p.client.protoIsAdc == true {
+		return fmt.Errorf("peer did not advertise a fingerprint")
+	}
+
+	store := p.client.conf.PeerTrustStore
+	if store == nil {
+		return nil
+	}
+
+	id := p.client.peerIdentity(p.peer)
+
+	storedFingerprint := store.Keyprint(id)
+	if storedFingerprint == connFingerprint {
+		return nil
+	}
+
+	if storedFingerprint != "" {
+		dolog(LevelInfo, "[peer] [%s] keyprint changed (%s vs %s)",
+			p.peer.Nick, connFingerprint, storedFingerprint)
+		if p.client.OnPeerKeyprintChanged != nil {
+			p.client.OnPeerKeyprintChanged(p.peer, storedFingerprint, connFingerprint)
+		}
+		if strict == true {
+			return fmt.Errorf("peer keyprint has changed")
+		}
+	}
+
+	return store.SetKeyprint(id, connFingerprint)
+}
@@ -5,22 +5,43 @@ import (
 	"compress/bzip2"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+	"strings"
 	"time"
 )
 
 const (
-	_PEER_WAIT_TIMEOUT = 10 * time.Second
+	_PEER_WAIT_TIMEOUT          = 10 * time.Second
+	_DOWNLOAD_RETRY_BACKOFF     = 5 * time.Second
+	_DOWNLOAD_RETRY_MAX_BACKOFF = 2 * time.Minute
 )
 
+// DownloadRetryPolicy allows to configure the automatic retry of a download
+// that has failed (peer not responding, slots full, etc).
+type DownloadRetryPolicy struct {
+	// the maximum number of retries, after which OnDownloadError is called.
+	// Leave zero to disable retries
+	MaxRetries uint
+	// the delay before the first retry, that is doubled after every retry.
+	// It defaults to 5 seconds
+	Backoff time.Duration
+	// the maximum delay between two retries. It defaults to 2 minutes
+	MaxBackoff time.Duration
+	// search the file TTH in the hub after every failure, in order to find
+	// alternate sources. Sources are used in rotation
+	SearchSources bool
+}
+
 // DownloadConf allows to configure a download.
 type DownloadConf struct {
 	// the peer from which downloading
 	Peer *Peer
 	// the TTH of the file to download
 	TTH TigerHash
+	// the path of the file to download, in the format /alias/dir/file. It can be
+	// used instead of TTH to download from legacy clients that do not provide
+	// TTHs. In this case the file is not validated
+	Path string
 	// the starting point of the file part to download, in bytes
 	Start uint64
 	// the length of the file part. Leave zero to download the entire file
@@ -29,6 +50,9 @@ type DownloadConf struct {
 	SavePath string
 	// after download, do not attempt to validate the file through its TTH
 	SkipValidation bool
+	// the policy used to retry the download when it fails. See DownloadRetryPolicy
+	// for the options
+	Retry DownloadRetryPolicy
 
 	isFilelist bool
 }
@@ -42,6 +66,8 @@ type Download struct {
 	state              string
 	activeDlChan       chan struct{}
 	slotChan           chan struct{}
+	activeDlHeld       bool // whether the current attempt holds the peer
+	slotHeld           bool // whether the current attempt holds a download slot
 	peerChan           chan struct{}
 	pconn              *connPeer
 	query              string
@@ -51,6 +77,11 @@ type Download struct {
 	offset             uint64
 	length             uint64
 	lastPrintTime      time.Time
+	sources            []*Peer
+	retries            uint
+	searchSession      *SearchSession
+	retryDelay         time.Duration
+	dirDownload        *DirectoryDownload
 }
 
 func (*Download) isTransfer() {}
@@ -103,36 +134,24 @@ func (c *Client) DownloadFLFile(peer *Peer, file *FileListFile, savePath string)
 	})
 }
 
-// DownloadFLDirectory starts downloading recursively all the files
-// inside a file list directory.
-func (c *Client) DownloadFLDirectory(peer *Peer, dir *FileListDirectory, savePath string) error {
-	var dlDir func(sdir *FileListDirectory, dpath string) error
-	dlDir = func(sdir *FileListDirectory, dpath string) error {
-		// create destionation directory if does not exist
-		os.Mkdir(dpath, 0755)
-
-		for _, file := range sdir.Files {
-			_, err := c.DownloadFLFile(peer, file, filepath.Join(dpath, file.Name))
-			if err != nil {
-				return err
-			}
-		}
-		for _, ssdir := range sdir.Dirs {
-			err := dlDir(ssdir, filepath.Join(dpath, ssdir.Name))
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	}
-	return dlDir(dir, savePath)
-}
-
-// DownloadFile starts downloading a file by its Tiger Tree Hash (TTH). See DownloadConf for the options.
+// DownloadFile starts downloading a file by its Tiger Tree Hash (TTH) or by
+// its path. See DownloadConf for the options.
 func (c *Client) DownloadFile(conf DownloadConf) (*Download, error) {
+	if conf.isFilelist == false && conf.TTH == (TigerHash{}) && conf.Path == "" {
+		return nil, fmt.Errorf("TTH or path is required")
+	}
+	if conf.Path != "" && strings.HasPrefix(conf.Path, "/") == false {
+		return nil, fmt.Errorf("path must start with a slash")
+	}
 	if conf.Length <= 0 {
 		conf.Length = -1
 	}
+	if conf.Retry.Backoff == 0 {
+		conf.Retry.Backoff = _DOWNLOAD_RETRY_BACKOFF
+	}
+	if conf.Retry.MaxBackoff == 0 {
+		conf.Retry.MaxBackoff = _DOWNLOAD_RETRY_MAX_BACKOFF
+	}
 
 	d := &Download{
 		conf:         conf,
@@ -142,6 +161,7 @@ func (c *Client) DownloadFile(conf DownloadConf) (*Download, error) {
 		activeDlChan: make(chan struct{}),
 		slotChan:     make(chan struct{}),
 		peerChan:     make(chan struct{}),
+		sources:      []*Peer{conf.Peer},
 	}
 	d.client.transfers[d] = struct{}{}
 
@@ -150,6 +170,9 @@ func (c *Client) DownloadFile(conf DownloadConf) (*Download, error) {
 		if d.conf.isFilelist == true {
 			return "file files.xml.bz2"
 		}
+		if d.conf.TTH == (TigerHash{}) {
+			return "file " + d.conf.Path
+		}
 		return "file TTH/" + d.conf.TTH.String()
 	}()
 
@@ -172,6 +195,28 @@ func (d *Download) Content() []byte {
 	return d.content
 }
 
+// Sources returns the peers from which the file can be downloaded. They are
+// used in rotation when the download is retried.
+func (d *Download) Sources() []*Peer {
+	return d.sources
+}
+
+// AddSource adds an alternate source to the download.
+func (d *Download) AddSource(peer *Peer) {
+	for _, p := range d.sources {
+		if p == peer {
+			return
+		}
+	}
+	dolog(LevelDebug, "[download] [%s] new source: %s", d.conf.Peer.Nick, peer.Nick)
+	d.sources = append(d.sources, peer)
+}
+
+// Retries returns how many times the download has been retried.
+func (d *Download) Retries() uint {
+	return d.retries
+}
+
 // Close stops the download. OnDownloadError and OnDownloadSuccessful are not called.
 func (d *Download) Close() {
 	if d.terminateRequested == true {
@@ -190,6 +235,21 @@ func (d *Download) do() {
 	defer d.client.wg.Done()
 
 	err := func() error {
+		// wait before retrying and switch source
+		if d.retries > 0 {
+			timer := time.NewTimer(d.retryDelay)
+			select {
+			case <-d.terminate:
+				timer.Stop()
+				return errorTerminated
+			case <-timer.C:
+			}
+
+			d.client.Safe(func() {
+				d.conf.Peer = d.nextSource()
+			})
+		}
+
 		// check if there are other downloads active on peer and eventually wait
 		wait := false
 		d.client.Safe(func() {
@@ -199,6 +259,7 @@ func (d *Download) do() {
 			} else {
 				d.state = "waited_activedl"
 				d.client.activeDownloadsByPeer[d.conf.Peer.Nick] = d
+				d.activeDlHeld = true
 			}
 		})
 		if wait == true {
@@ -218,6 +279,7 @@ func (d *Download) do() {
 			} else {
 				d.state = "waited_slot"
 				d.client.downloadSlotAvail -= 1
+				d.slotHeld = true
 			}
 		})
 		if wait == true {
@@ -265,7 +327,33 @@ func (d *Download) do() {
 		// process download
 		dolog(LevelInfo, "[download] [%s] processing", d.conf.Peer.Nick)
 
-		if d.client.protoIsAdc == true {
+		// legacy NMDC clients do not support ADCGET, files can be requested
+		// only by path
+		_, peerSupportsAdcGet := d.pconn.remoteFeatures[nmdcFeatureAdcGet]
+
+		if d.client.protoIsAdc == false && peerSupportsAdcGet == false {
+			if strings.HasPrefix(d.query, "file /") == false {
+				return fmt.Errorf("peer does not support ADCGet")
+			}
+
+			if _, ok := d.pconn.remoteFeatures[nmdcFeatureFileListBzip]; ok {
+				d.pconn.conn.Write(&msgNmdcUGetBlock{
+					Start:  d.conf.Start,
+					Length: d.conf.Length,
+					Path:   nmdcPathEncode(d.conf.Path),
+				})
+
+			} else {
+				if d.conf.Length > 0 {
+					return fmt.Errorf("peer does not support partial downloads")
+				}
+				d.pconn.conn.Write(&msgNmdcGet{
+					Path:   nmdcPathEncode(d.conf.Path),
+					Offset: d.conf.Start + 1,
+				})
+			}
+
+		} else if d.client.protoIsAdc == true {
 			d.pconn.conn.Write(&msgAdcCGetFile{
 				msgAdcTypeC{},
 				msgAdcKeyGetFile{
@@ -365,6 +453,23 @@ func (d *Download) handleDownload(msgi msgDecodable) error {
 	case *msgNmdcSendFile:
 		return d.handleSendFile(msg.Query, msg.Start, msg.Length, msg.Compressed)
 
+	case *msgNmdcFailed:
+		return fmt.Errorf("error: %s", msg.Error)
+
+	case *msgNmdcSending:
+		return d.handleSendFile(d.query, d.conf.Start, msg.Length, false)
+
+	case *msgNmdcFileLength:
+		if msg.Length <= d.conf.Start {
+			return fmt.Errorf("peer returned wrong length: %d", msg.Length)
+		}
+		err := d.handleSendFile(d.query, d.conf.Start, msg.Length-d.conf.Start, false)
+		if err != nil {
+			return err
+		}
+		// content is sent after $Send
+		d.pconn.conn.Write(&msgNmdcSend{})
+
 	case *msgBinary:
 		newLength := d.offset + uint64(len(msg.Content))
 		if newLength > d.length {
@@ -389,7 +494,7 @@ func (d *Download) handleDownload(msgi msgDecodable) error {
 			d.pconn.conn.SetReadBinary(false)
 			d.writer.Close()
 
-			// file list: unzip in final path
+			// file list: unzip in final path, checking that it is valid
 			if d.conf.isFilelist {
 				if d.conf.SavePath != "" {
 					srcf, err := os.Open(d.conf.SavePath + ".tmp")
@@ -403,7 +508,7 @@ func (d *Download) handleDownload(msgi msgDecodable) error {
 						return err
 					}
 
-					_, err = io.Copy(destf, bzip2.NewReader(srcf))
+					err = fileListCopy(destf, bzip2.NewReader(srcf))
 					srcf.Close()
 					destf.Close()
 					if err != nil {
@@ -415,17 +520,18 @@ func (d *Download) handleDownload(msgi msgDecodable) error {
 					}
 
 				} else {
-					cnt, err := ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(d.content)))
-					if err != nil {
+					var buf bytes.Buffer
+					if err := fileListCopy(&buf, bzip2.NewReader(bytes.NewReader(d.content))); err != nil {
 						return err
 					}
-					d.content = cnt
+					d.content = buf.Bytes()
 				}
 
 				// normal file
 			} else {
-				// validate
-				if d.conf.SkipValidation == false && d.conf.Start == 0 && d.conf.Length <= 0 {
+				// validate (files requested by path do not have a TTH)
+				if d.conf.SkipValidation == false && d.conf.TTH != (TigerHash{}) &&
+					d.conf.Start == 0 && d.conf.Length <= 0 {
 					dolog(LevelInfo, "[download] [%s] validating", d.conf.Peer.Nick)
 
 					// file in disk
@@ -464,39 +570,141 @@ func (d *Download) handleDownload(msgi msgDecodable) error {
 	return nil
 }
 
+func (d *Download) nextSource() *Peer {
+	cur := 0
+	for i, p := range d.sources {
+		if p == d.conf.Peer {
+			cur = i
+			break
+		}
+	}
+
+	// pick the next source that is still connected to the hub
+	for i := 1; i <= len(d.sources); i++ {
+		p := d.sources[(cur+i)%len(d.sources)]
+		if d.client.peers[p.Nick] == p {
+			return p
+		}
+	}
+	return d.conf.Peer
+}
+
+func (d *Download) handleSearchResult(sr *SearchResult) {
+	if d.conf.Retry.SearchSources == true && sr.IsDir == false &&
+		d.conf.TTH != (TigerHash{}) && sr.TTH == d.conf.TTH {
+		d.AddSource(sr.Peer)
+	}
+}
+
+func (d *Download) retry() {
+	d.retries++
+
+	d.retryDelay = d.conf.Retry.Backoff
+	for i := uint(1); i < d.retries && d.retryDelay < d.conf.Retry.MaxBackoff; i++ {
+		d.retryDelay *= 2
+	}
+	if d.retryDelay > d.conf.Retry.MaxBackoff {
+		d.retryDelay = d.conf.Retry.MaxBackoff
+	}
+
+	// search alternate sources
+	if d.conf.Retry.SearchSources == true && d.conf.TTH != (TigerHash{}) &&
+		d.client.connHub.state == "initialized" {
+		if d.searchSession != nil {
+			d.searchSession.Close()
+		}
+		var err error
+		d.searchSession, err = d.client.Search(SearchConf{
+			Type:     SearchTTH,
+			TTH:      d.conf.TTH,
+			Priority: SearchPriorityLow,
+		})
+		if err == nil {
+			d.searchSession.OnResult = d.handleSearchResult
+		}
+	}
+
+	// reset state
+	if d.writer != nil {
+		d.writer.Close()
+	}
+	// the next attempt starts from scratch, remove the partial content
+	if d.conf.SavePath != "" {
+		if err := os.Remove(d.conf.SavePath + ".tmp"); err != nil && os.IsNotExist(err) == false {
+			dolog(LevelInfo, "ERR (download): unable to remove partial file: %s", err)
+		}
+	}
+	d.state = "waiting_retry"
+	d.pconn = nil
+	d.adcToken = ""
+	d.writer = nil
+	d.content = nil
+	d.offset = 0
+	d.length = 0
+
+	dolog(LevelInfo, "[download] [%s] retrying %s in %v (%d/%d)", d.conf.Peer.Nick,
+		dcReadableQuery(d.query), d.retryDelay, d.retries, d.conf.Retry.MaxRetries)
+
+	if d.client.OnDownloadRetry != nil {
+		d.client.OnDownloadRetry(d)
+	}
+
+	d.client.wg.Add(1)
+	go d.do()
+}
+
 func (d *Download) handleExit(err error) {
 	if d.terminateRequested != true && err != nil {
 		dolog(LevelInfo, "ERR (download) [%s]: %s", d.conf.Peer.Nick, err)
 	}
 
-	delete(d.client.transfers, d)
-
-	// free activedl and unlock next download
-	delete(d.client.activeDownloadsByPeer, d.conf.Peer.Nick)
-	for rot := range d.client.transfers {
-		if od, ok := rot.(*Download); ok {
-			if od.terminateRequested == false && od.state == "waiting_activedl" && d.conf.Peer == od.conf.Peer {
-				od.state = "waited_activedl"
-				od.client.activeDownloadsByPeer[od.conf.Peer.Nick] = d
-				od.activeDlChan <- struct{}{}
-				break
+	// free activedl and unlock next download. Nothing is freed if the download
+	// has been terminated before acquiring it, or while waiting for a retry
+	if d.activeDlHeld == true {
+		d.activeDlHeld = false
+		delete(d.client.activeDownloadsByPeer, d.conf.Peer.Nick)
+		for rot := range d.client.transfers {
+			if od, ok := rot.(*Download); ok {
+				if od.terminateRequested == false && od.state == "waiting_activedl" && d.conf.Peer == od.conf.Peer {
+					od.state = "waited_activedl"
+					od.client.activeDownloadsByPeer[od.conf.Peer.Nick] = od
+					od.activeDlHeld = true
+					od.activeDlChan <- struct{}{}
+					break
+				}
 			}
 		}
 	}
 
 	// free slot and unlock next download
-	d.client.downloadSlotAvail += 1
-	for rot := range d.client.transfers {
-		if od, ok := rot.(*Download); ok {
-			if od.terminateRequested == false && od.state == "waiting_slot" {
-				od.state = "waited_slot"
-				od.client.downloadSlotAvail -= 1
-				od.slotChan <- struct{}{}
-				break
+	if d.slotHeld == true {
+		d.slotHeld = false
+		d.client.downloadSlotAvail += 1
+		for rot := range d.client.transfers {
+			if od, ok := rot.(*Download); ok {
+				if od.terminateRequested == false && od.state == "waiting_slot" {
+					od.state = "waited_slot"
+					od.client.downloadSlotAvail -= 1
+					od.slotHeld = true
+					od.slotChan <- struct{}{}
+					break
+				}
 			}
 		}
 	}
 
+	// retry
+	if err != nil && d.terminateRequested == false && d.retries < d.conf.Retry.MaxRetries {
+		d.retry()
+		return
+	}
+
+	delete(d.client.transfers, d)
+
+	if d.searchSession != nil {
+		d.searchSession.Close()
+	}
+
 	// call callbacks
 	if err == nil {
 		dolog(LevelInfo, "[download] [%s] finished %s (s=%d l=%d)",
@@ -510,4 +718,8 @@ func (d *Download) handleExit(err error) {
 			d.client.OnDownloadError(d)
 		}
 	}
+
+	if d.dirDownload != nil {
+		d.dirDownload.handleFileExit(d, err)
+	}
 }
@@ -0,0 +1,276 @@
+package dctoolkit
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// DirectoryFileState contains the state of a file that is part of a directory download.
+type DirectoryFileState int
+
+const (
+	// DirectoryFileQueued means that the file is waiting to be downloaded or is downloading
+	DirectoryFileQueued DirectoryFileState = iota
+	// DirectoryFileFinished means that the file has been downloaded
+	DirectoryFileFinished
+	// DirectoryFileFailed means that the file download has failed
+	DirectoryFileFailed
+	// DirectoryFileSkipped means that the file has been skipped, since it already
+	// exists on disk or it is excluded
+	DirectoryFileSkipped
+)
+
+// DirectoryDownloadConf allows to configure the download of a directory.
+type DirectoryDownloadConf struct {
+	// the peer from which downloading
+	Peer *Peer
+	// the file list directory to download
+	Dir *FileListDirectory
+	// the path on disk in which the directory is saved
+	SavePath string
+	// do not download files that already exist on disk with the same size
+	SkipExisting bool
+	// do not download files whose name or relative path matches one of these
+	// glob patterns (i.e. *.nfo)
+	Exclude []string
+	// the policy used to retry the download of every file. See DownloadRetryPolicy
+	Retry DownloadRetryPolicy
+}
+
+// DirectoryDownloadFile contains the status of a file that is part of a directory download.
+type DirectoryDownloadFile struct {
+	// path of the file, relative to the directory
+	Path string
+	// the file list entry
+	File *FileListFile
+	// the file state. See DirectoryFileState for the available states
+	State DirectoryFileState
+	// the file download, if the file has not been skipped
+	Download *Download
+}
+
+// DirectoryDownload represents an in-progress directory download.
+type DirectoryDownload struct {
+	conf               DirectoryDownloadConf
+	client             *Client
+	terminateRequested bool
+	files              []*DirectoryDownloadFile
+	filesByDownload    map[*Download]*DirectoryDownloadFile
+}
+
+// DownloadFLDirectory starts downloading recursively all the files
+// inside a file list directory.
+func (c *Client) DownloadFLDirectory(peer *Peer, dir *FileListDirectory, savePath string) (*DirectoryDownload, error) {
+	return c.DownloadDirectory(DirectoryDownloadConf{
+		Peer:     peer,
+		Dir:      dir,
+		SavePath: savePath,
+	})
+}
+
+// DownloadDirectory starts downloading recursively all the files inside a
+// file list directory. See DirectoryDownloadConf for the options.
+// OnDirectoryDownloadFinished is called when all the files have been processed.
+func (c *Client) DownloadDirectory(conf DirectoryDownloadConf) (*DirectoryDownload, error) {
+	for _, pattern := range conf.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	dd := &DirectoryDownload{
+		conf:            conf,
+		client:          c,
+		filesByDownload: make(map[*Download]*DirectoryDownloadFile),
+	}
+
+	var dlDir func(sdir *FileListDirectory, rpath string) error
+	dlDir = func(sdir *FileListDirectory, rpath string) error {
+		// create destination directory if does not exist
+		if err := os.MkdirAll(filepath.Join(conf.SavePath, rpath), 0755); err != nil {
+			return err
+		}
+
+		for _, file := range sdir.Files {
+			df := &DirectoryDownloadFile{
+				Path: path.Join(rpath, file.Name),
+				File: file,
+			}
+			dd.files = append(dd.files, df)
+			savePath := filepath.Join(conf.SavePath, df.Path)
+
+			if dd.isExcluded(df.Path) {
+				df.State = DirectoryFileSkipped
+				continue
+			}
+
+			if conf.SkipExisting == true {
+				if finfo, err := os.Stat(savePath); err == nil && uint64(finfo.Size()) == file.Size {
+					df.State = DirectoryFileSkipped
+					continue
+				}
+			}
+
+			// null files cannot be downloaded, create them directly
+			if file.Size == 0 {
+				f, err := os.Create(savePath)
+				if err != nil {
+					return err
+				}
+				f.Close()
+				df.State = DirectoryFileFinished
+				continue
+			}
+
+			d, err := c.DownloadFile(DownloadConf{
+				Peer:     conf.Peer,
+				TTH:      file.TTH,
+				SavePath: savePath,
+				Retry:    conf.Retry,
+			})
+			if err != nil {
+				return err
+			}
+			d.dirDownload = dd
+			df.Download = d
+			dd.filesByDownload[d] = df
+		}
+
+		for _, ssdir := range sdir.Dirs {
+			if err := dlDir(ssdir, path.Join(rpath, ssdir.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := dlDir(conf.Dir, ""); err != nil {
+		dd.Close()
+		return nil, err
+	}
+
+	// nothing to download, call the callback outside this context
+	if len(dd.filesByDownload) == 0 {
+		go c.Safe(func() {
+			if dd.terminateRequested == false {
+				dd.handleFinished()
+			}
+		})
+	}
+
+	return dd, nil
+}
+
+func (dd *DirectoryDownload) isExcluded(rpath string) bool {
+	for _, pattern := range dd.conf.Exclude {
+		if ok, _ := path.Match(pattern, path.Base(rpath)); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, rpath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Conf returns the configuration passed at download initialization.
+func (dd *DirectoryDownload) Conf() DirectoryDownloadConf {
+	return dd.conf
+}
+
+// Files returns the status of every file inside the directory.
+func (dd *DirectoryDownload) Files() []*DirectoryDownloadFile {
+	return dd.files
+}
+
+// TotalFiles returns the number of files to download (skipped files excluded).
+func (dd *DirectoryDownload) TotalFiles() int {
+	count := 0
+	for _, df := range dd.files {
+		if df.State != DirectoryFileSkipped {
+			count++
+		}
+	}
+	return count
+}
+
+// FinishedFiles returns the number of files that have been downloaded.
+func (dd *DirectoryDownload) FinishedFiles() int {
+	return dd.countState(DirectoryFileFinished)
+}
+
+// FailedFiles returns the number of files whose download has failed.
+func (dd *DirectoryDownload) FailedFiles() int {
+	return dd.countState(DirectoryFileFailed)
+}
+
+func (dd *DirectoryDownload) countState(state DirectoryFileState) int {
+	count := 0
+	for _, df := range dd.files {
+		if df.State == state {
+			count++
+		}
+	}
+	return count
+}
+
+// TotalBytes returns the size of the files to download (skipped files excluded).
+func (dd *DirectoryDownload) TotalBytes() uint64 {
+	size := uint64(0)
+	for _, df := range dd.files {
+		if df.State != DirectoryFileSkipped {
+			size += df.File.Size
+		}
+	}
+	return size
+}
+
+// FinishedBytes returns the amount of bytes downloaded, including the
+// progress of the files that are being downloaded.
+func (dd *DirectoryDownload) FinishedBytes() uint64 {
+	size := uint64(0)
+	for _, df := range dd.files {
+		switch df.State {
+		case DirectoryFileFinished:
+			size += df.File.Size
+		case DirectoryFileQueued:
+			size += df.Download.offset
+		}
+	}
+	return size
+}
+
+// Close stops the download of every file. OnDirectoryDownloadFinished is not called.
+func (dd *DirectoryDownload) Close() {
+	if dd.terminateRequested == true {
+		return
+	}
+	dd.terminateRequested = true
+
+	for d := range dd.filesByDownload {
+		d.Close()
+	}
+}
+
+func (dd *DirectoryDownload) handleFileExit(d *Download, err error) {
+	df := dd.filesByDownload[d]
+	delete(dd.filesByDownload, d)
+
+	if err == nil {
+		df.State = DirectoryFileFinished
+	} else {
+		df.State = DirectoryFileFailed
+	}
+
+	if len(dd.filesByDownload) == 0 && dd.terminateRequested == false {
+		dd.handleFinished()
+	}
+}
+
+func (dd *DirectoryDownload) handleFinished() {
+	dolog(LevelInfo, "[download] [%s] directory finished (%d/%d files)",
+		dd.conf.Peer.Nick, dd.FinishedFiles(), dd.TotalFiles())
+	if dd.client.OnDirectoryDownloadFinished != nil {
+		dd.client.OnDirectoryDownloadFinished(dd)
+	}
+}
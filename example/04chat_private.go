@@ -18,9 +18,24 @@ func main() {
 		panic(err)
 	}
 
-	// a private message has been received: reply to sender
-	client.OnMessagePrivate = func(p *dctk.Peer, content string) {
-		client.MessagePrivate(p, fmt.Sprintf("message received! (%s)", content))
+	// a private message has been received: reply to sender.
+	// endToEnd is true when the message has been received through an encrypted
+	// direct connection (ADC CCPM), that cannot be read by the hub
+	client.OnMessagePrivate = func(p *dctk.Peer, content string, endToEnd bool) {
+		route := client.MessagePrivate(p, fmt.Sprintf("message received! (%s)", content))
+		if route == dctk.PrivateMessageDirect {
+			fmt.Println("reply sent through a direct connection")
+		}
+	}
+
+	// a reply has been queued while the direct connection was being
+	// established, and has been sent
+	client.OnMessagePrivateSent = func(p *dctk.Peer, content string, route dctk.PrivateMessageRoute) {
+		if route == dctk.PrivateMessageDirect {
+			fmt.Println("reply sent through a direct connection")
+		} else {
+			fmt.Println("direct connection failed, reply sent through the hub")
+		}
 	}
 
 	client.Run()
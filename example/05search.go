@@ -5,6 +5,7 @@ package main
 import (
 	"fmt"
 	dctk "github.com/gswly/dctoolkit"
+	"time"
 )
 
 func main() {
@@ -23,8 +24,29 @@ func main() {
 	// hub is connected, start searching
 	client.OnHubConnected = func() {
 		// search by name
+		session, err := client.Search(dctk.SearchConf{
+			Query:   "test",
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		// searches are queued in order to avoid flooding the hub
+		fmt.Printf("search will be sent in %v\n", session.EstimatedWait())
+
+		// the session has expired: print files grouped by TTH, starting from
+		// the ones with the most sources
+		session.OnClose = func() {
+			for _, g := range session.Groups() {
+				fmt.Printf("file: %s (%d sources)\n", g.TTH, len(g.Results))
+			}
+		}
+
+		// search videos by name
 		client.Search(dctk.SearchConf{
-			Query: "test",
+			Query:    "test",
+			FileType: dctk.FileTypeVideo,
 		})
 	}
 
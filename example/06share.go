@@ -3,7 +3,9 @@
 package main
 
 import (
+	"fmt"
 	dctk "github.com/gswly/dctoolkit"
+	"time"
 )
 
 func main() {
@@ -15,6 +17,19 @@ func main() {
 		UdpPort:          3009,
 		TcpTlsPort:       3010,
 		HubManualConnect: true,
+		// store TTHs on disk, in order to avoid computing them again at every start
+		HashDatabasePath: "/var/lib/dctk/hashes.db",
+		// hash 4 files in parallel, reading from disk at most at 50 MiB/s
+		HashWorkers:  4,
+		HashMaxSpeed: 50 * 1024 * 1024,
+		// do not share hidden files and temporary files
+		ShareExclusion: dctk.ShareExclusion{
+			SkipHidden: true,
+			Globs:      []string{"*.tmp", "*.part"},
+		},
+		// detect changes through inotify (Linux only) and rescan periodically
+		ShareWatch:          true,
+		ShareRescanInterval: 1 * time.Hour,
 	})
 	if err != nil {
 		panic(err)
@@ -23,6 +38,25 @@ func main() {
 	// wait initialization and start indexing
 	client.OnInitialized = func() {
 		client.ShareAdd("share", "/etc")
+
+		// this directory is visible only to friends
+		client.ShareAddRoot(dctk.ShareRootConf{
+			Alias: "private",
+			Path:  "/srv/private",
+			Scope: dctk.ShareScope{FriendsOnly: true},
+			// share also the directories linked from here
+			FollowSymlinks: true,
+		})
+		client.FriendAdd("friendnick")
+	}
+
+	client.OnHashProgress = func(file string, done uint64, total uint64, bytesPerSec uint64) {
+		fmt.Printf("hashing %s: %d/%d bytes, %d KiB/s\n", file, done, total, bytesPerSec/1024)
+	}
+
+	// files that cannot be read are skipped and reported here
+	client.OnShareIndexError = func(path string, err error) {
+		fmt.Printf("unable to index %s: %s\n", path, err)
 	}
 
 	// wait indexing and connect to hub
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"fmt"
 	dctk "github.com/gswly/dctoolkit"
 )
 
@@ -45,16 +46,19 @@ func main() {
 			}
 
 			// download every file in the directory
-			client.DownloadFLDirectory(d.Conf().Peer, dir, "/tmp/directory")
-
-			// a file has been downloaded
-		} else {
-			// all files have been downloaded
-			if client.DownloadCount() == 0 {
-				client.Close()
+			_, err = client.DownloadFLDirectory(d.Conf().Peer, dir, "/tmp/directory")
+			if err != nil {
+				panic(err)
 			}
 		}
 	}
 
+	// all files have been processed
+	client.OnDirectoryDownloadFinished = func(dd *dctk.DirectoryDownload) {
+		fmt.Printf("downloaded %d/%d files (%d bytes)\n",
+			dd.FinishedFiles(), dd.TotalFiles(), dd.FinishedBytes())
+		client.Close()
+	}
+
 	client.Run()
 }
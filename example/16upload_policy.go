@@ -0,0 +1,44 @@
+// +build ignore
+
+package main
+
+import (
+	dctk "github.com/gswly/dctoolkit"
+)
+
+func main() {
+	// configure hub in active mode but do not connect automatically. local ports must be opened and accessible.
+	client, err := dctk.NewClient(dctk.ClientConf{
+		HubUrl:           "adc://hubip:5000",
+		Nick:             "mynick",
+		TcpPort:          3009,
+		UdpPort:          3009,
+		TcpTlsPort:       3010,
+		HubManualConnect: true,
+		// serve the "company" directory only to operators and to some peers
+		// of the local network. Everything else is served to everybody.
+		UploadPolicy: &dctk.UploadRulePolicy{
+			Rules: []dctk.UploadRule{
+				{Roots: []string{"company"}, OperatorsOnly: true},
+				{Roots: []string{"company"}, Nicks: []string{"alice", "bob"}, Ips: []string{"192.168.0.0/16"}},
+				{Roots: []string{"company"}, Deny: true, Reason: "Reserved to staff"},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// wait initialization and start indexing
+	client.OnInitialized = func() {
+		client.ShareAdd("public", "/srv/public")
+		client.ShareAdd("company", "/srv/company")
+	}
+
+	// wait indexing and connect to hub
+	client.OnShareIndexed = func() {
+		client.HubConnect()
+	}
+
+	client.Run()
+}
@@ -0,0 +1,54 @@
+// +build ignore
+
+package main
+
+import (
+	"fmt"
+	dctk "github.com/gswly/dctoolkit"
+	"strings"
+)
+
+func main() {
+	// connect to hub in active mode. local ports must be opened and accessible.
+	client, err := dctk.NewClient(dctk.ClientConf{
+		HubUrl:     "nmdc://hubip:411",
+		Nick:       "mynick",
+		TcpPort:    3009,
+		UdpPort:    3009,
+		TcpTlsPort: 3010,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// count the searched queries
+	queries := make(map[string]int)
+
+	// a search request has been received from a peer. Requests dropped by
+	// the rate limiter are reported too, with Answered set to false
+	client.OnSearchRequest = func(r *dctk.SearchRequest) {
+		nick := ""
+		if r.Peer != nil {
+			nick = r.Peer.Nick
+		}
+		if r.Answered == false {
+			nick += " (not answered)"
+		}
+
+		if r.Type == dctk.SearchTTH {
+			fmt.Printf("search by %s: TTH %s\n", nick, r.TTH)
+			return
+		}
+
+		fmt.Printf("search by %s: %s\n", nick, r.Query)
+		queries[r.Query]++
+
+		// reply with a file that is not in the share
+		if strings.Contains(strings.ToLower(r.Query), "readme") {
+			r.AddResult("/virtual/readme.txt", false, 1024,
+				dctk.TigerHashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"))
+		}
+	}
+
+	client.Run()
+}
@@ -0,0 +1,47 @@
+// +build ignore
+
+package main
+
+import (
+	"fmt"
+	dctk "github.com/gswly/dctoolkit"
+	"io/ioutil"
+)
+
+func main() {
+	// read a file list previously downloaded and decompressed
+	content, err := ioutil.ReadFile("/tmp/files.xml")
+	if err != nil {
+		panic(err)
+	}
+
+	fl, err := dctk.FileListParse(content)
+	if err != nil {
+		panic(err)
+	}
+
+	// print every directory with its total size
+	fl.Walk(func(e *dctk.FileListEntry) error {
+		if e.Dir != nil {
+			stats := e.Dir.Stats()
+			fmt.Printf("%s: %d files, %d bytes\n", e.Path, stats.FileCount, stats.Size)
+		}
+		return nil
+	})
+
+	// search videos by name
+	for _, e := range fl.Search(dctk.SearchConf{
+		Query:    "test",
+		FileType: dctk.FileTypeVideo,
+	}) {
+		fmt.Printf("found: %s\n", e.Path)
+	}
+
+	// print files that are shared multiple times
+	for _, group := range fl.Duplicates() {
+		fmt.Printf("duplicate (%d bytes):\n", group[0].File.Size)
+		for _, e := range group {
+			fmt.Printf("  %s\n", e.Path)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package dctoolkit
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 )
@@ -33,13 +35,27 @@ type FileList struct {
 
 // FileListParse parses a given user file list in XML format into a FileList struct.
 func FileListParse(in []byte) (*FileList, error) {
-	fl := &FileList{}
+	r, err := NewFileListReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	return r.readAll()
+}
+
+// FileListParseFile parses a user file list stored on disk, in XML format,
+// compressed with bzip2 (files.xml.bz2) or not.
+func FileListParseFile(fpath string) (*FileList, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	err := xml.Unmarshal(in, fl)
+	r, err := NewFileListReader(f)
 	if err != nil {
 		return nil, err
 	}
-	return fl, err
+	return r.readAll()
 }
 
 // GetDirectory returns the directory in the file list corresponding to the given path.
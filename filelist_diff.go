@@ -0,0 +1,208 @@
+package dctoolkit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// FileListChange is a file that differs between two file lists.
+type FileListChange struct {
+	// path in the old file list, empty if the file has been added
+	OldPath string
+	// path in the new file list, empty if the file has been removed
+	NewPath string
+	// the file in the old file list, nil if the file has been added
+	Old *FileListFile
+	// the file in the new file list, nil if the file has been removed
+	New *FileListFile
+}
+
+// FileListDiffSummary contains the number and size of changed files.
+type FileListDiffSummary struct {
+	Added        uint
+	AddedSize    uint64
+	Removed      uint
+	RemovedSize  uint64
+	Modified     uint
+	Moved        uint
+	SizeOld      uint64
+	SizeNew      uint64
+	FileCountOld uint
+	FileCountNew uint
+}
+
+// String implements fmt.Stringer.
+func (s FileListDiffSummary) String() string {
+	return fmt.Sprintf("%d added (%d bytes), %d removed (%d bytes), %d modified, %d moved; "+
+		"%d files (%d bytes) -> %d files (%d bytes)",
+		s.Added, s.AddedSize, s.Removed, s.RemovedSize, s.Modified, s.Moved,
+		s.FileCountOld, s.SizeOld, s.FileCountNew, s.SizeNew)
+}
+
+// FileListChanges contains the differences between two file lists. Changes
+// are sorted by path.
+type FileListChanges struct {
+	// files that are present only in the new file list
+	Added []*FileListChange
+	// files that are present only in the old file list
+	Removed []*FileListChange
+	// files with the same path and a different content
+	Modified []*FileListChange
+	// files with the same content (TTH) and a different path
+	Moved   []*FileListChange
+	Summary FileListDiffSummary
+}
+
+// FileListDiff returns the differences between two versions of a file list.
+// Directories are not compared, only the files they contain.
+func FileListDiff(oldList *FileList, newList *FileList) *FileListChanges {
+	files := func(fl *FileList) map[string]*FileListFile {
+		ret := make(map[string]*FileListFile)
+		fl.Walk(func(e *FileListEntry) error {
+			if e.File != nil {
+				ret[e.Path] = e.File
+			}
+			return nil
+		})
+		return ret
+	}
+	return fileListDiff(files(oldList), files(newList))
+}
+
+// FileListDiffFiles returns the differences between two versions of a file
+// list stored on disk, compressed with bzip2 (files.xml.bz2) or not. File
+// lists are read with a FileListReader, therefore only their files are kept
+// in memory.
+func FileListDiffFiles(oldPath string, newPath string) (*FileListChanges, error) {
+	files := func(fpath string) (map[string]*FileListFile, error) {
+		f, err := os.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		r, err := NewFileListReader(f)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := make(map[string]*FileListFile)
+		for {
+			e, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if e.File != nil {
+				ret[e.Path] = e.File
+			}
+		}
+		return ret, nil
+	}
+
+	oldFiles, err := files(oldPath)
+	if err != nil {
+		return nil, err
+	}
+
+	newFiles, err := files(newPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileListDiff(oldFiles, newFiles), nil
+}
+
+// fileListDiff compares two file lists, given as maps of files by path.
+func fileListDiff(oldFiles map[string]*FileListFile, newFiles map[string]*FileListFile) *FileListChanges {
+	ch := &FileListChanges{}
+
+	// files that are present only in the new list, grouped by TTH
+	addedByTTH := make(map[TigerHash][]string)
+	for fpath, nf := range newFiles {
+		of, ok := oldFiles[fpath]
+		if !ok {
+			addedByTTH[nf.TTH] = append(addedByTTH[nf.TTH], fpath)
+			continue
+		}
+		if of.TTH != nf.TTH || of.Size != nf.Size {
+			ch.Modified = append(ch.Modified, &FileListChange{
+				OldPath: fpath,
+				NewPath: fpath,
+				Old:     of,
+				New:     nf,
+			})
+		}
+	}
+	for _, paths := range addedByTTH {
+		sort.Strings(paths)
+	}
+
+	// removed files are moved if a file with the same TTH has been added
+	var removedPaths []string
+	for fpath := range oldFiles {
+		if _, ok := newFiles[fpath]; !ok {
+			removedPaths = append(removedPaths, fpath)
+		}
+	}
+	sort.Strings(removedPaths)
+
+	for _, fpath := range removedPaths {
+		of := oldFiles[fpath]
+		if paths := addedByTTH[of.TTH]; len(paths) > 0 {
+			addedByTTH[of.TTH] = paths[1:]
+			ch.Moved = append(ch.Moved, &FileListChange{
+				OldPath: fpath,
+				NewPath: paths[0],
+				Old:     of,
+				New:     newFiles[paths[0]],
+			})
+			continue
+		}
+		ch.Removed = append(ch.Removed, &FileListChange{
+			OldPath: fpath,
+			Old:     of,
+		})
+	}
+
+	for _, paths := range addedByTTH {
+		for _, fpath := range paths {
+			ch.Added = append(ch.Added, &FileListChange{
+				NewPath: fpath,
+				New:     newFiles[fpath],
+			})
+		}
+	}
+
+	sort.Slice(ch.Added, func(i, j int) bool {
+		return ch.Added[i].NewPath < ch.Added[j].NewPath
+	})
+	sort.Slice(ch.Modified, func(i, j int) bool {
+		return ch.Modified[i].NewPath < ch.Modified[j].NewPath
+	})
+
+	ch.Summary.Added = uint(len(ch.Added))
+	for _, c := range ch.Added {
+		ch.Summary.AddedSize += c.New.Size
+	}
+	ch.Summary.Removed = uint(len(ch.Removed))
+	for _, c := range ch.Removed {
+		ch.Summary.RemovedSize += c.Old.Size
+	}
+	ch.Summary.Modified = uint(len(ch.Modified))
+	ch.Summary.Moved = uint(len(ch.Moved))
+	for _, f := range oldFiles {
+		ch.Summary.SizeOld += f.Size
+	}
+	ch.Summary.FileCountOld = uint(len(oldFiles))
+	for _, f := range newFiles {
+		ch.Summary.SizeNew += f.Size
+	}
+	ch.Summary.FileCountNew = uint(len(newFiles))
+
+	return ch
+}
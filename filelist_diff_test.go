@@ -0,0 +1,186 @@
+package dctoolkit
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testRemoveFile removes a file from a directory of a file list and returns it.
+func testRemoveFile(t *testing.T, fl *FileList, dpath string, name string) *FileListFile {
+	dir, err := fl.GetDirectory(dpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range dir.Files {
+		if f.Name == name {
+			dir.Files = append(dir.Files[:i], dir.Files[i+1:]...)
+			return f
+		}
+	}
+	t.Fatalf("file not found: %s/%s", dpath, name)
+	return nil
+}
+
+// testAddFile adds a file to a directory of a file list.
+func testAddFile(t *testing.T, fl *FileList, dpath string, f *FileListFile) {
+	dir, err := fl.GetDirectory(dpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir.Files = append(dir.Files, f)
+}
+
+func TestFileListDiff(t *testing.T) {
+	paths := func(changes []*FileListChange) []string {
+		ret := []string{}
+		for _, c := range changes {
+			ret = append(ret, c.OldPath+">"+c.NewPath)
+		}
+		return ret
+	}
+
+	for _, ca := range []struct {
+		name     string
+		change   func(t *testing.T, fl *FileList)
+		added    []string
+		removed  []string
+		modified []string
+		moved    []string
+	}{
+		{
+			"unchanged",
+			func(t *testing.T, fl *FileList) {},
+			[]string{},
+			[]string{},
+			[]string{},
+			[]string{},
+		},
+		{
+			"added",
+			func(t *testing.T, fl *FileList) {
+				testAddFile(t, fl, "/docs", &FileListFile{Name: "new.txt", Size: 20, TTH: testTTH(5)})
+			},
+			[]string{">/docs/new.txt"},
+			[]string{},
+			[]string{},
+			[]string{},
+		},
+		{
+			"removed",
+			func(t *testing.T, fl *FileList) {
+				testRemoveFile(t, fl, "/docs", "manual.pdf")
+			},
+			[]string{},
+			[]string{"/docs/manual.pdf>"},
+			[]string{},
+			[]string{},
+		},
+		{
+			"modified",
+			func(t *testing.T, fl *FileList) {
+				f, _ := fl.GetFile("/docs/manual.pdf")
+				f.Size = 120
+				f.TTH = testTTH(5)
+			},
+			[]string{},
+			[]string{},
+			[]string{"/docs/manual.pdf>/docs/manual.pdf"},
+			[]string{},
+		},
+		{
+			"renamed",
+			func(t *testing.T, fl *FileList) {
+				f, _ := fl.GetFile("/docs/manual.pdf")
+				f.Name = "guide.pdf"
+			},
+			[]string{},
+			[]string{},
+			[]string{},
+			[]string{"/docs/manual.pdf>/docs/guide.pdf"},
+		},
+		{
+			"moved between directories",
+			func(t *testing.T, fl *FileList) {
+				testAddFile(t, fl, "/docs", testRemoveFile(t, fl, "/music", "cover.jpg"))
+			},
+			[]string{},
+			[]string{},
+			[]string{},
+			[]string{"/music/cover.jpg>/docs/cover.jpg"},
+		},
+		{
+			"duplicate moved and renamed",
+			func(t *testing.T, fl *FileList) {
+				f := testRemoveFile(t, fl, "/music/album", "notes.txt")
+				f.Name = "notes copy.txt"
+				testAddFile(t, fl, "/docs", f)
+			},
+			[]string{},
+			[]string{},
+			[]string{},
+			[]string{"/music/album/notes.txt>/docs/notes copy.txt"},
+		},
+		{
+			"all",
+			func(t *testing.T, fl *FileList) {
+				testAddFile(t, fl, "/music", &FileListFile{Name: "new.mp3", Size: 20, TTH: testTTH(5)})
+				testRemoveFile(t, fl, "/music", "cover.jpg")
+				f, _ := fl.GetFile("/docs/manual.pdf")
+				f.Size = 120
+				f.TTH = testTTH(6)
+				f, _ = fl.GetFile("/music/album/song copy.mp3")
+				f.Name = "song.mp3"
+			},
+			[]string{">/music/new.mp3"},
+			[]string{"/music/cover.jpg>"},
+			[]string{"/docs/manual.pdf>/docs/manual.pdf"},
+			[]string{"/music/album/song copy.mp3>/music/album/song.mp3"},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			newList := testFileList(t)
+			ca.change(t, newList)
+
+			ch := FileListDiff(testFileList(t), newList)
+			if v := paths(ch.Added); !reflect.DeepEqual(v, ca.added) {
+				t.Errorf("added: expected %v, got %v", ca.added, v)
+			}
+			if v := paths(ch.Removed); !reflect.DeepEqual(v, ca.removed) {
+				t.Errorf("removed: expected %v, got %v", ca.removed, v)
+			}
+			if v := paths(ch.Modified); !reflect.DeepEqual(v, ca.modified) {
+				t.Errorf("modified: expected %v, got %v", ca.modified, v)
+			}
+			if v := paths(ch.Moved); !reflect.DeepEqual(v, ca.moved) {
+				t.Errorf("moved: expected %v, got %v", ca.moved, v)
+			}
+		})
+	}
+}
+
+func TestFileListDiffSummary(t *testing.T) {
+	newList := testFileList(t)
+	testAddFile(t, newList, "/music", &FileListFile{Name: "new.mp3", Size: 20, TTH: testTTH(5)})
+	testRemoveFile(t, newList, "/music", "cover.jpg")
+	f, _ := newList.GetFile("/docs/manual.pdf")
+	f.Size = 120
+	f.TTH = testTTH(6)
+	f, _ = newList.GetFile("/music/album/song copy.mp3")
+	f.Name = "song.mp3"
+
+	expected := FileListDiffSummary{
+		Added:        1,
+		AddedSize:    20,
+		Removed:      1,
+		RemovedSize:  10,
+		Modified:     1,
+		Moved:        1,
+		SizeOld:      725,
+		SizeNew:      755,
+		FileCountOld: 7,
+		FileCountNew: 7,
+	}
+	if s := FileListDiff(testFileList(t), newList).Summary; s != expected {
+		t.Errorf("expected %+v, got %+v", expected, s)
+	}
+}
@@ -0,0 +1,177 @@
+package dctoolkit
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileListEntry is a file or directory of a file list, together with its path.
+type FileListEntry struct {
+	// path in the format /directory/subdirectory/file
+	Path string
+	// the directory, if the entry is a directory
+	Dir *FileListDirectory
+	// the file, if the entry is a file
+	File *FileListFile
+}
+
+// FileListStats contains aggregate values of a directory or file list.
+type FileListStats struct {
+	// total size of the files, including the ones in subdirectories
+	Size uint64
+	// number of files, including the ones in subdirectories
+	FileCount uint
+	// number of subdirectories, at any depth
+	DirCount uint
+}
+
+// Walk calls fn for every directory and file of the file list. A directory is
+// visited before its files and subdirectories. If fn returns filepath.SkipDir
+// when called on a directory, its content is skipped; when called on a file,
+// the remaining content of the containing directory is skipped. Any other
+// error stops the walk and is returned.
+func (fl *FileList) Walk(fn func(e *FileListEntry) error) error {
+	var walkDir func(dpath string, dir *FileListDirectory) error
+	walkDir = func(dpath string, dir *FileListDirectory) error {
+		if err := fn(&FileListEntry{Path: dpath, Dir: dir}); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+
+		for _, f := range dir.Files {
+			if err := fn(&FileListEntry{Path: dpath + "/" + f.Name, File: f}); err != nil {
+				if err == filepath.SkipDir {
+					return nil
+				}
+				return err
+			}
+		}
+
+		for _, sdir := range dir.Dirs {
+			if err := walkDir(dpath+"/"+sdir.Name, sdir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, dir := range fl.Dirs {
+		if err := walkDir("/"+dir.Name, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindByTTH returns the files of the file list with the given TTH.
+func (fl *FileList) FindByTTH(tth TigerHash) []*FileListEntry {
+	var ret []*FileListEntry
+	fl.Walk(func(e *FileListEntry) error {
+		if e.File != nil && e.File.TTH == tth {
+			ret = append(ret, e)
+		}
+		return nil
+	})
+	return ret
+}
+
+// Search returns the files and directories of the file list that match the
+// given search, with the same rules used to reply to searches from other peers.
+// See SearchConf for the available options. Timeout and Priority are ignored.
+func (fl *FileList) Search(conf SearchConf) []*FileListEntry {
+	if conf.Type == SearchTTH {
+		return fl.FindByTTH(conf.TTH)
+	}
+
+	req := &searchIncomingRequest{
+		stype:    conf.Type,
+		fileType: conf.FileType,
+		minSize:  conf.MinSize,
+		maxSize:  conf.MaxSize,
+		terms:    strings.Fields(conf.Query),
+	}
+	req.normalize()
+
+	var ret []*FileListEntry
+	fl.Walk(func(e *FileListEntry) error {
+		if e.Dir != nil && req.isExcluded(e.Path) == true {
+			return filepath.SkipDir
+		}
+
+		// every term must be contained in the path
+		lpath := strings.ToLower(e.Path)
+		for _, term := range req.terms {
+			if strings.Contains(lpath, term) == false {
+				return nil
+			}
+		}
+
+		if e.Dir != nil {
+			if req.dirMatches() == true {
+				ret = append(ret, e)
+			}
+		} else if req.fileMatches(e.Path, e.File.Size) == true {
+			ret = append(ret, e)
+		}
+		return nil
+	})
+	return ret
+}
+
+// Stats returns aggregate values of the directory, i.e. its total size and the
+// number of files and directories it contains.
+func (d *FileListDirectory) Stats() FileListStats {
+	var ret FileListStats
+	for _, f := range d.Files {
+		ret.Size += f.Size
+		ret.FileCount++
+	}
+	for _, sdir := range d.Dirs {
+		sub := sdir.Stats()
+		ret.Size += sub.Size
+		ret.FileCount += sub.FileCount
+		ret.DirCount += sub.DirCount + 1
+	}
+	return ret
+}
+
+// Stats returns aggregate values of the whole file list.
+func (fl *FileList) Stats() FileListStats {
+	var ret FileListStats
+	for _, dir := range fl.Dirs {
+		sub := dir.Stats()
+		ret.Size += sub.Size
+		ret.FileCount += sub.FileCount
+		ret.DirCount += sub.DirCount + 1
+	}
+	return ret
+}
+
+// Duplicates returns the groups of files of the file list that have the same
+// TTH, starting from the biggest files.
+func (fl *FileList) Duplicates() [][]*FileListEntry {
+	byTTH := make(map[TigerHash][]*FileListEntry)
+	fl.Walk(func(e *FileListEntry) error {
+		if e.File != nil {
+			byTTH[e.File.TTH] = append(byTTH[e.File.TTH], e)
+		}
+		return nil
+	})
+
+	var ret [][]*FileListEntry
+	for _, group := range byTTH {
+		if len(group) > 1 {
+			ret = append(ret, group)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i][0].File.Size != ret[j][0].File.Size {
+			return ret[i][0].File.Size > ret[j][0].File.Size
+		}
+		return ret[i][0].Path < ret[j][0].Path
+	})
+	return ret
+}
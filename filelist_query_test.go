@@ -0,0 +1,218 @@
+package dctoolkit
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testEntryPaths(entries []*FileListEntry) []string {
+	var ret []string
+	for _, e := range entries {
+		ret = append(ret, e.Path)
+	}
+	return ret
+}
+
+func TestFileListWalk(t *testing.T) {
+	fl := testFileList(t)
+
+	var paths []string
+	err := fl.Walk(func(e *FileListEntry) error {
+		paths = append(paths, e.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// directories are visited before their files, files before subdirectories
+	expected := []string{
+		"/music",
+		"/music/song.mp3",
+		"/music/cover.jpg",
+		"/music/album",
+		"/music/album/song copy.mp3",
+		"/music/album/notes.txt",
+		"/docs",
+		"/docs/notes.txt",
+		"/docs/manual.pdf",
+		"/docs/notes backup.txt",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+}
+
+func TestFileListWalkStop(t *testing.T) {
+	fl := testFileList(t)
+
+	for _, ca := range []struct {
+		name     string
+		stopAt   string
+		err      error
+		expected []string
+	}{
+		{
+			"error",
+			"/music/cover.jpg",
+			fmt.Errorf("stop"),
+			[]string{"/music", "/music/song.mp3", "/music/cover.jpg"},
+		},
+		{
+			"skip directory",
+			"/music",
+			filepath.SkipDir,
+			[]string{"/music", "/docs", "/docs/notes.txt", "/docs/manual.pdf", "/docs/notes backup.txt"},
+		},
+		{
+			"skip from file",
+			"/music/song.mp3",
+			filepath.SkipDir,
+			[]string{"/music", "/music/song.mp3", "/docs", "/docs/notes.txt",
+				"/docs/manual.pdf", "/docs/notes backup.txt"},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			var paths []string
+			err := fl.Walk(func(e *FileListEntry) error {
+				paths = append(paths, e.Path)
+				if e.Path == ca.stopAt {
+					return ca.err
+				}
+				return nil
+			})
+
+			if ca.err == filepath.SkipDir {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			} else if err != ca.err {
+				t.Errorf("expected error %v, got %v", ca.err, err)
+			}
+			if !reflect.DeepEqual(paths, ca.expected) {
+				t.Errorf("expected %v, got %v", ca.expected, paths)
+			}
+		})
+	}
+}
+
+func TestFileListSearch(t *testing.T) {
+	fl := testFileList(t)
+
+	for _, ca := range []struct {
+		name     string
+		conf     SearchConf
+		expected []string
+	}{
+		{
+			"files by name",
+			SearchConf{Query: "notes"},
+			[]string{"/music/album/notes.txt", "/docs/notes.txt", "/docs/notes backup.txt"},
+		},
+		{
+			"terms in different components",
+			SearchConf{Query: "album NOTES"},
+			[]string{"/music/album/notes.txt"},
+		},
+		{
+			"directory with its content",
+			SearchConf{Query: "album"},
+			[]string{"/music/album", "/music/album/song copy.mp3", "/music/album/notes.txt"},
+		},
+		{
+			"directories only",
+			SearchConf{Type: SearchDirectory, Query: "music"},
+			[]string{"/music", "/music/album"},
+		},
+		{
+			"file type",
+			SearchConf{Query: "o", FileType: FileTypeAudio},
+			[]string{"/music/song.mp3", "/music/album/song copy.mp3"},
+		},
+		{
+			"min size, applied to directories too",
+			SearchConf{Query: "docs", MinSize: 50},
+			[]string{"/docs", "/docs/manual.pdf"},
+		},
+		{
+			"max size",
+			SearchConf{Query: "notes", MaxSize: 50},
+			[]string{"/music/album/notes.txt", "/docs/notes.txt", "/docs/notes backup.txt"},
+		},
+		{
+			"TTH",
+			SearchConf{Type: SearchTTH, TTH: testTTH(4)},
+			[]string{"/docs/manual.pdf"},
+		},
+		{
+			"no results",
+			SearchConf{Query: "nonexistent"},
+			nil,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			if paths := testEntryPaths(fl.Search(ca.conf)); !reflect.DeepEqual(paths, ca.expected) {
+				t.Errorf("expected %v, got %v", ca.expected, paths)
+			}
+		})
+	}
+}
+
+func TestFileListFindByTTH(t *testing.T) {
+	fl := testFileList(t)
+
+	expected := []string{"/music/album/notes.txt", "/docs/notes.txt", "/docs/notes backup.txt"}
+	if paths := testEntryPaths(fl.FindByTTH(testTTH(3))); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	if entries := fl.FindByTTH(testTTH(100)); len(entries) != 0 {
+		t.Errorf("unexpected entries: %v", testEntryPaths(entries))
+	}
+}
+
+func TestFileListStats(t *testing.T) {
+	fl := testFileList(t)
+
+	for _, ca := range []struct {
+		dir      string
+		expected FileListStats
+	}{
+		{"/music", FileListStats{Size: 615, FileCount: 4, DirCount: 1}},
+		{"/music/album", FileListStats{Size: 305, FileCount: 2, DirCount: 0}},
+		{"/docs", FileListStats{Size: 110, FileCount: 3, DirCount: 0}},
+	} {
+		dir, err := fl.GetDirectory(ca.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := dir.Stats(); s != ca.expected {
+			t.Errorf("%s: expected %+v, got %+v", ca.dir, ca.expected, s)
+		}
+	}
+
+	expected := FileListStats{Size: 725, FileCount: 7, DirCount: 3}
+	if s := fl.Stats(); s != expected {
+		t.Errorf("expected %+v, got %+v", expected, s)
+	}
+}
+
+func TestFileListDuplicates(t *testing.T) {
+	fl := testFileList(t)
+
+	var groups [][]string
+	for _, group := range fl.Duplicates() {
+		groups = append(groups, testEntryPaths(group))
+	}
+
+	// groups are sorted by size, and files inside groups by walk order
+	expected := [][]string{
+		{"/music/song.mp3", "/music/album/song copy.mp3"},
+		{"/music/album/notes.txt", "/docs/notes.txt", "/docs/notes backup.txt"},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected %v, got %v", expected, groups)
+	}
+}
@@ -0,0 +1,198 @@
+package dctoolkit
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// fileListDecompress returns a reader that decompresses the file list if it is
+// compressed with bzip2, detected through its magic number.
+func fileListDecompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(magic) == "BZh" {
+		return bzip2.NewReader(br), nil
+	}
+	return br, nil
+}
+
+// FileListReader reads a user file list incrementally, in order to process
+// very large lists with bounded memory usage. Entries are returned in the
+// order in which they appear in the file list, and a directory is always
+// returned before its content.
+type FileListReader struct {
+	dec    *xml.Decoder
+	header FileList
+	// paths of the directories that are being read
+	dirPaths []string
+}
+
+// NewFileListReader allocates a FileListReader, that reads a file list in XML
+// format, compressed with bzip2 (files.xml.bz2) or not.
+func NewFileListReader(r io.Reader) (*FileListReader, error) {
+	dr, err := fileListDecompress(r)
+	if err != nil {
+		return nil, err
+	}
+
+	flr := &FileListReader{
+		dec: xml.NewDecoder(dr),
+	}
+
+	// read header
+	for {
+		tok, err := flr.dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("FileListing not found")
+			}
+			return nil, err
+		}
+
+		if t, ok := tok.(xml.StartElement); ok {
+			if t.Name.Local != "FileListing" {
+				return nil, fmt.Errorf("unexpected element: %s", t.Name.Local)
+			}
+			flr.header.XMLName = t.Name
+			for _, attr := range t.Attr {
+				switch attr.Name.Local {
+				case "Version":
+					flr.header.Version = attr.Value
+				case "CID":
+					flr.header.CID = attr.Value
+				case "Base":
+					flr.header.Base = attr.Value
+				case "Generator":
+					flr.header.Generator = attr.Value
+				}
+			}
+			return flr, nil
+		}
+	}
+}
+
+// Header returns the attributes of the file list (version, CID, base and
+// generator). Directories are not included.
+func (r *FileListReader) Header() FileList {
+	return r.header
+}
+
+// Next returns the next file or directory of the file list, or io.EOF when
+// the file list has been read entirely. Directories are returned without
+// their content, that is returned by the following calls.
+func (r *FileListReader) Next() (*FileListEntry, error) {
+	for {
+		tok, err := r.dec.Token()
+		if err != nil {
+			if err == io.EOF && len(r.dirPaths) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "Directory":
+				dir := &FileListDirectory{}
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "Name" {
+						dir.Name = attr.Value
+					}
+				}
+				dpath := "/" + dir.Name
+				if len(r.dirPaths) > 0 {
+					dpath = r.dirPaths[len(r.dirPaths)-1] + dpath
+				}
+				r.dirPaths = append(r.dirPaths, dpath)
+				return &FileListEntry{Path: dpath, Dir: dir}, nil
+
+			case "File":
+				if len(r.dirPaths) == 0 {
+					return nil, fmt.Errorf("file outside directories")
+				}
+				file := &FileListFile{}
+				if err := r.dec.DecodeElement(file, &t); err != nil {
+					return nil, err
+				}
+				return &FileListEntry{Path: r.dirPaths[len(r.dirPaths)-1] + "/" + file.Name, File: file}, nil
+
+			default:
+				if err := r.dec.Skip(); err != nil {
+					return nil, err
+				}
+			}
+
+		case xml.EndElement:
+			if t.Name.Local == "Directory" {
+				r.dirPaths = r.dirPaths[:len(r.dirPaths)-1]
+			}
+		}
+	}
+}
+
+// fileListCopy copies a file list from r to w, and checks that it can be read
+// entirely.
+func fileListCopy(w io.Writer, r io.Reader) error {
+	tee := io.TeeReader(r, w)
+
+	flr, err := NewFileListReader(tee)
+	if err != nil {
+		return err
+	}
+	for {
+		_, err := flr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// copy what follows the end of the file list
+	_, err = io.Copy(ioutil.Discard, tee)
+	return err
+}
+
+// readAll reads the remaining entries and returns the whole file list.
+func (r *FileListReader) readAll() (*FileList, error) {
+	fl := r.Header()
+
+	// the directories that contain the current entry
+	var stack []*FileListDirectory
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if e.Dir != nil {
+			// the directory itself has already been added to dirPaths
+			stack = stack[:len(r.dirPaths)-1]
+			if len(stack) == 0 {
+				fl.Dirs = append(fl.Dirs, e.Dir)
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Dirs = append(parent.Dirs, e.Dir)
+			}
+			stack = append(stack, e.Dir)
+
+		} else {
+			stack = stack[:len(r.dirPaths)]
+			parent := stack[len(stack)-1]
+			parent.Files = append(parent.Files, e.File)
+		}
+	}
+	return &fl, nil
+}
@@ -0,0 +1,190 @@
+package dctoolkit
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testFileListXML = `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<FileListing Version="1" CID="TESTCID" Base="/" Generator="test">
+    <Directory Name="music">
+        <File Name="a.mp3" Size="1" TTH="AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"/>
+        <Directory Name="album">
+            <File Name="b.mp3" Size="2" TTH="AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"/>
+            <Directory Name="empty"></Directory>
+        </Directory>
+        <File Name="c.mp3" Size="3" TTH="AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"/>
+    </Directory>
+    <Directory Name="docs">
+        <File Name="d.txt" Size="4" TTH="AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"/>
+    </Directory>
+</FileListing>`
+
+func TestFileListReaderOrder(t *testing.T) {
+	r, err := NewFileListReader(strings.NewReader(testFileListXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := r.Header()
+	if h.Version != "1" || h.CID != "TESTCID" || h.Base != "/" || h.Generator != "test" {
+		t.Errorf("wrong header: %+v", h)
+	}
+
+	var paths []string
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Dir != nil {
+			paths = append(paths, "D "+e.Path)
+		} else {
+			paths = append(paths, "F "+e.Path)
+		}
+	}
+
+	// entries are returned in document order, even if files follow
+	// subdirectories
+	expected := []string{
+		"D /music",
+		"F /music/a.mp3",
+		"D /music/album",
+		"F /music/album/b.mp3",
+		"D /music/album/empty",
+		"F /music/c.mp3",
+		"D /docs",
+		"F /docs/d.txt",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+}
+
+func TestFileListReaderMalformed(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"wrong root", `<Other><Directory Name="a"></Directory></Other>`},
+		{"file outside directories", `<FileListing><File Name="a" Size="1"/></FileListing>`},
+		{"invalid xml", `<FileListing><Directory Name="a"><File Name="b" Size="x"/></Directory></FileListing>`},
+		{"unclosed element", `<FileListing><Directory Name="a"></File></FileListing>`},
+		{"truncated", testFileListXML[:len(testFileListXML)/2]},
+		{"truncated after directory", testFileListXML[:strings.Index(testFileListXML, "<Directory Name=\"docs\">")]},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			err := func() error {
+				r, err := NewFileListReader(strings.NewReader(ca.in))
+				if err != nil {
+					return err
+				}
+				for {
+					_, err := r.Next()
+					if err == io.EOF {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+				}
+			}()
+			if err == nil {
+				t.Errorf("expected error")
+			}
+
+			if _, err := FileListParse([]byte(ca.in)); err == nil {
+				t.Errorf("expected error from FileListParse")
+			}
+		})
+	}
+}
+
+func TestFileListParseGenerated(t *testing.T) {
+	fl := &FileList{
+		CID:       "TESTCID",
+		Generator: "test",
+		Dirs: []*FileListDirectory{
+			{
+				Name: "music",
+				Files: []*FileListFile{
+					{Name: "a.mp3", Size: 1, TTH: testTTH(1)},
+					{Name: "b.mp3", Size: 2, TTH: testTTH(2)},
+				},
+				Dirs: []*FileListDirectory{
+					{
+						Name:  "album",
+						Files: []*FileListFile{{Name: "c.mp3", Size: 3, TTH: testTTH(3)}},
+						Dirs:  []*FileListDirectory{{Name: "empty"}},
+					},
+				},
+			},
+			{
+				Name:  "docs",
+				Files: []*FileListFile{{Name: "d.txt", Size: 4, TTH: testTTH(4)}},
+			},
+		},
+	}
+	content, err := fl.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reference result, obtained by decoding the whole document
+	expected := &FileList{}
+	if err := xml.Unmarshal(content, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := FileListParse(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("FileListParse: result differs")
+	}
+
+	dir, err := ioutil.TempDir("", "dctk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "files.xml")
+	if err := ioutil.WriteFile(fpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err = FileListParseFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("FileListParseFile: result differs")
+	}
+}
+
+func TestFileListCopy(t *testing.T) {
+	var buf bytes.Buffer
+	if err := fileListCopy(&buf, strings.NewReader(testFileListXML+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != testFileListXML+"\n" {
+		t.Errorf("content differs")
+	}
+
+	buf.Reset()
+	if err := fileListCopy(&buf, strings.NewReader(testFileListXML[:100])); err == nil {
+		t.Errorf("expected error")
+	}
+}
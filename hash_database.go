@@ -0,0 +1,258 @@
+package dctoolkit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	// maximum number of leaves stored for every shared file. Leaves are merged
+	// level by level until their count is below this limit.
+	_TTHL_MAX_LEAVES = 512
+	// the database is compacted automatically after an indexing when the
+	// share of dead lines (overridden or not shared anymore) exceeds this ratio
+	_HASH_DATABASE_COMPACT_RATIO = 0.5
+	// minimum number of dead lines that triggers an automatic compaction
+	_HASH_DATABASE_COMPACT_MIN = 1000
+)
+
+// hashDatabaseEntry is a line of the hash database.
+type hashDatabaseEntry struct {
+	Path    string      `json:"p"`
+	Size    uint64      `json:"s"`
+	ModTime int64       `json:"m"`
+	Inode   uint64      `json:"i"`
+	TTH     TigerHash   `json:"t"`
+	Leaves  TigerLeaves `json:"l,omitempty"`
+}
+
+// hashDatabase stores the TTHs and the reduced leaves of shared files on disk,
+// in order to avoid computing them again after a restart. It is an append-only
+// log of JSON lines, in which the last entry of every path overrides the
+// previous ones.
+type hashDatabase struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]*hashDatabaseEntry
+	// number of lines in the file, including dead ones
+	lines int
+}
+
+func newHashDatabase(path string) (*hashDatabase, error) {
+	db := &hashDatabase{
+		path:    path,
+		entries: make(map[string]*hashDatabaseEntry),
+	}
+
+	f, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			db.lines++
+			var entry hashDatabaseEntry
+			// skip corrupted lines, i.e. the last line after a crash
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			db.entries[entry.Path] = &entry
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+	} else if os.IsNotExist(err) == false {
+		return nil, err
+	}
+
+	db.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	dolog(LevelInfo, "[share] hash database loaded (%d entries)", len(db.entries))
+	return db, nil
+}
+
+func (db *hashDatabase) close() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.file.Close()
+}
+
+// get returns the entry of a file, if it exists and the file has not changed.
+func (db *hashDatabase) get(path string, finfo os.FileInfo) *hashDatabaseEntry {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	entry, ok := db.entries[path]
+	if ok == false ||
+		entry.Size != uint64(finfo.Size()) ||
+		entry.ModTime != finfo.ModTime().UnixNano() ||
+		entry.Inode != fileInode(finfo) {
+		return nil
+	}
+	return entry
+}
+
+func (db *hashDatabase) set(path string, finfo os.FileInfo, tth TigerHash, tthl TigerLeaves) error {
+	entry := &hashDatabaseEntry{
+		Path:    path,
+		Size:    uint64(finfo.Size()),
+		ModTime: finfo.ModTime().UnixNano(),
+		Inode:   fileInode(finfo),
+		TTH:     tth,
+		Leaves:  tthl,
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	byts, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := db.file.Write(append(byts, '\n')); err != nil {
+		return err
+	}
+	db.entries[path] = entry
+	db.lines++
+	return nil
+}
+
+// needsCompaction checks whether the share of dead lines, i.e. lines that have
+// been overridden or whose path is not contained in keep, exceeds the
+// compaction threshold.
+func (db *hashDatabase) needsCompaction(keep map[string]struct{}) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	live := 0
+	for path := range db.entries {
+		if _, ok := keep[path]; ok {
+			live++
+		}
+	}
+	dead := db.lines - live
+	return dead >= _HASH_DATABASE_COMPACT_MIN &&
+		float64(dead) > _HASH_DATABASE_COMPACT_RATIO*float64(db.lines)
+}
+
+// compact rewrites the database, keeping only the entries whose path is
+// contained in keep.
+func (db *hashDatabase) compact(keep map[string]struct{}) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	removed := 0
+	for path := range db.entries {
+		if _, ok := keep[path]; !ok {
+			delete(db.entries, path)
+			removed++
+		}
+	}
+
+	tmpPath := db.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+
+	err = func() error {
+		w := bufio.NewWriter(f)
+		for _, entry := range db.entries {
+			byts, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(append(byts, '\n')); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}()
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	db.file.Close()
+	if err := os.Rename(tmpPath, db.path); err != nil {
+		os.Remove(tmpPath)
+		// keep appending to the original database
+		var err2 error
+		db.file, err2 = os.OpenFile(db.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err2 != nil {
+			return 0, err2
+		}
+		return 0, err
+	}
+
+	db.lines = len(db.entries)
+	db.file, err = os.OpenFile(db.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// HashDatabaseLookup returns the TTH of a file on disk, if it is stored in the
+// hash database and the file has not changed since it was hashed.
+func (c *Client) HashDatabaseLookup(fpath string) (TigerHash, bool) {
+	if c.hashDatabase == nil {
+		return TigerHash{}, false
+	}
+
+	finfo, err := os.Stat(fpath)
+	if err != nil {
+		return TigerHash{}, false
+	}
+
+	entry := c.hashDatabase.get(fpath, finfo)
+	if entry == nil {
+		return TigerHash{}, false
+	}
+	return entry.TTH, true
+}
+
+// hashDatabaseKeep returns the disk paths of the files of a share tree, whose
+// entries must be kept in the hash database.
+func hashDatabaseKeep(tree map[string]*shareDirectory) map[string]struct{} {
+	keep := make(map[string]struct{})
+	var scanDir func(dir *shareDirectory)
+	scanDir = func(dir *shareDirectory) {
+		for _, file := range dir.files {
+			keep[file.realPath] = struct{}{}
+		}
+		for _, sdir := range dir.dirs {
+			scanDir(sdir)
+		}
+	}
+	for _, dir := range tree {
+		scanDir(dir)
+	}
+	return keep
+}
+
+// HashDatabaseCompact removes from the hash database the entries of files
+// that are not shared anymore, and rewrites it on disk. The database is also
+// compacted automatically after an indexing, when most of its lines are dead.
+func (c *Client) HashDatabaseCompact() error {
+	if c.hashDatabase == nil {
+		return fmt.Errorf("hash database is disabled")
+	}
+
+	removed, err := c.hashDatabase.compact(hashDatabaseKeep(c.shareTree))
+	if err != nil {
+		return err
+	}
+	dolog(LevelInfo, "[share] hash database compacted (%d entries removed)", removed)
+	return nil
+}
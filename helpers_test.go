@@ -0,0 +1,75 @@
+package dctoolkit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// keep the test output readable
+func init() {
+	SetLogLevel(LevelError)
+}
+
+// testTTH returns a TTH that identifies a test file by number.
+func testTTH(n int) TigerHash {
+	var tth TigerHash
+	binary.BigEndian.PutUint32(tth[:], uint32(n))
+	return tth
+}
+
+// testShareClient returns a client that shares a synthetic tree, made of
+// dirCount directories ("album N") of fileCount files ("track N-M.ext").
+func testShareClient(dirCount int, fileCount int) *Client {
+	c := &Client{
+		shareRoots: map[string]*shareRoot{"share": {}},
+		shareTree:  make(map[string]*shareDirectory),
+	}
+
+	root := &shareDirectory{
+		dirs:      make(map[string]*shareDirectory),
+		files:     make(map[string]*shareFile),
+		aliasPath: "/share",
+	}
+	c.shareTree["share"] = root
+
+	exts := []string{"mp3", "avi", "txt", "iso", "jpg"}
+	for i := 0; i < dirCount; i++ {
+		dname := fmt.Sprintf("album %d", i)
+		dir := &shareDirectory{
+			dirs:      make(map[string]*shareDirectory),
+			files:     make(map[string]*shareFile),
+			aliasPath: root.aliasPath + "/" + dname,
+		}
+		root.dirs[dname] = dir
+
+		for j := 0; j < fileCount; j++ {
+			fname := fmt.Sprintf("track %d-%d.%s", i, j, exts[j%len(exts)])
+			dir.files[fname] = &shareFile{
+				size:      uint64(1000 + i*j),
+				tth:       testTTH(i*fileCount + j),
+				aliasPath: dir.aliasPath + "/" + fname,
+			}
+			dir.size += uint64(1000 + i*j)
+		}
+	}
+
+	c.shareIndex = newShareIndex(c.shareTree)
+	return c
+}
+
+// testFileList returns the file list stored in testdata/filelist_query.xml.
+// Its files have the TTHs returned by testTTH.
+func testFileList(t *testing.T) *FileList {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "filelist_query.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl, err := FileListParse(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fl
+}
@@ -0,0 +1,26 @@
+// +build !windows
+
+package dctoolkit
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode of a file, used to detect files that have been
+// replaced.
+func fileInode(finfo os.FileInfo) uint64 {
+	if st, ok := finfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// fileDevice returns the device that contains a file, used together with the
+// inode to detect directory loops.
+func fileDevice(finfo os.FileInfo) uint64 {
+	if st, ok := finfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
@@ -0,0 +1,18 @@
+// +build windows
+
+package dctoolkit
+
+import (
+	"os"
+)
+
+// fileInode returns the inode of a file. Inodes are not available on Windows.
+func fileInode(finfo os.FileInfo) uint64 {
+	return 0
+}
+
+// fileDevice returns the device that contains a file. Devices are not
+// available on Windows.
+func fileDevice(finfo os.FileInfo) uint64 {
+	return 0
+}
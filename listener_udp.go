@@ -3,6 +3,7 @@ package dctoolkit
 import (
 	"fmt"
 	"net"
+	"strings"
 )
 
 type listenerUdp struct {
@@ -48,12 +49,23 @@ func (u *listenerUdp) do() {
 		u.client.Safe(func() {
 			err := func() error {
 				if u.client.protoIsAdc == true {
-					if msgStr[len(msgStr)-1] != '\n' {
+					// encrypted result (SUDP): try the keys of the ongoing searches
+					var keys [][]byte
+					for s := range u.client.searchSessions {
+						if s.sudpKey != nil {
+							keys = append(keys, s.sudpKey)
+						}
+					}
+					if plain, ok := adcSudpDecryptResult(keys, []byte(msgStr)); ok {
+						msgStr = string(plain)
+					}
+
+					if len(msgStr) == 0 || msgStr[len(msgStr)-1] != '\n' {
 						return fmt.Errorf("wrong terminator")
 					}
 					msgStr = msgStr[:len(msgStr)-1]
 
-					if msgStr[:5] != "URES " {
+					if strings.HasPrefix(msgStr, "URES ") == false {
 						return fmt.Errorf("wrong command")
 					}
 
@@ -77,7 +89,7 @@ func (u *listenerUdp) do() {
 					return nil
 
 				} else {
-					if msgStr[len(msgStr)-1] != '|' {
+					if len(msgStr) == 0 || msgStr[len(msgStr)-1] != '|' {
 						return fmt.Errorf("wrong terminator")
 					}
 					msgStr = msgStr[:len(msgStr)-1]
@@ -113,3 +125,34 @@ func (u *listenerUdp) do() {
 		})
 	}
 }
+
+// udpWrite sends messages to a peer through the UDP listener, or through an
+// unbound socket when the listener is not available (passive mode), in order
+// to avoid opening a socket for every request.
+func (c *Client) udpWrite(ip string, port uint, msgs [][]byte) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, numtoa(port)))
+	if err != nil {
+		return err
+	}
+
+	conn := func() net.PacketConn {
+		if c.listenerUdp != nil {
+			return c.listenerUdp.listener
+		}
+		return c.udpSender
+	}()
+	if conn == nil {
+		conn, err = net.ListenPacket("udp", ":0")
+		if err != nil {
+			return err
+		}
+		c.udpSender = conn
+	}
+
+	for _, msg := range msgs {
+		if _, err := conn.WriteTo(msg, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
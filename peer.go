@@ -62,6 +62,29 @@ func (c *Client) peerByClientId(clientId []byte) *Peer {
 	return nil
 }
 
+func (c *Client) peerByIp(ip string) *Peer {
+	var ret *Peer
+	for _, p := range c.peers {
+		if p.Ip == ip {
+			// ip is shared by multiple peers
+			if ret != nil {
+				return nil
+			}
+			ret = p
+		}
+	}
+	return ret
+}
+
+// peerIdentity returns the identifier used to recognize a peer across
+// sessions: the client ID in ADC, the nickname in NMDC.
+func (c *Client) peerIdentity(p *Peer) string {
+	if c.protoIsAdc == true {
+		return dcBase32Encode(p.adcClientId)
+	}
+	return p.Nick
+}
+
 func (c *Client) peerSupportsEncryption(p *Peer) bool {
 	if c.protoIsAdc == true {
 		if p.adcFingerprint != "" {
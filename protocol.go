@@ -25,6 +25,7 @@ type protocol interface {
 	Close()
 	SetSyncMode(val bool)
 	SetReadBinary(val bool)
+	DisableReadTimeout()
 	Read() (msgDecodable, error)
 	Write(msg msgEncodable)
 	WriteSync(in []byte) error
@@ -43,7 +44,7 @@ type timedConn struct {
 }
 
 func newTimedConn(conn net.Conn, readTimeout time.Duration,
-	writeTimeout time.Duration) io.ReadWriteCloser {
+	writeTimeout time.Duration) *timedConn {
 	return &timedConn{
 		Closer:       conn,
 		conn:         conn,
@@ -116,6 +117,7 @@ type protocolBase struct {
 	sendChan    chan []byte
 	terminated  bool
 	closer      io.Closer
+	timedConn   *timedConn
 	monitoredConnIntf
 	reader       *lineproto.Reader
 	writer       *lineproto.Writer
@@ -150,6 +152,7 @@ func newProtocolBase(remoteLabel string, nconn net.Conn,
 		msgDelim:          msgDelim,
 		writerJoined:      make(chan struct{}),
 		closer:            mc,
+		timedConn:         tc,
 		monitoredConnIntf: mc,
 		reader:            rdr,
 		writer:            wri,
@@ -195,6 +198,12 @@ func (p *protocolBase) SetReadBinary(val bool) {
 	p.readBinary = val
 }
 
+// DisableReadTimeout must be called by the reading routine.
+func (p *protocolBase) DisableReadTimeout() {
+	p.timedConn.readTimeout = 0
+	p.timedConn.conn.SetReadDeadline(time.Time{})
+}
+
 func (p *protocolBase) ReadMessage() (string, error) {
 	// Close() was called in a previous run
 	if p.terminated == true {
@@ -23,6 +23,7 @@ const (
 	// client <-> client features
 	adcFeatureZlibGet      = "ADZLIG"
 	adcFeatureFileListBzip = "ADBZIP"
+	adcFeatureCcpm         = "ADCCPM"
 )
 
 const (
@@ -31,6 +32,8 @@ const (
 	adcSupportUdp4                  = "UDP4"
 	adcSupportTls                   = "ADCS"
 	adcSupportFileExtensionGrouping = "SEGA"
+	adcSupportCcpm                  = "CCPM"
+	adcSupportSudp                  = "SUD1"
 )
 
 const (
@@ -57,6 +60,8 @@ const (
 	adcFieldUdpPort              = "U4"
 	adcFieldPrivateId            = "PD"
 	adcFieldTlsFingerprint       = "KP"
+	// private message infos
+	adcFieldPmQuit = "QU"
 	// search requests & results
 	adcFieldMinSize           = "GE"
 	adcFieldMaxSize           = "LE"
@@ -70,6 +75,7 @@ const (
 	adcFieldFileTTH           = "TR"
 	adcFieldFileGroup         = "GR"
 	adcFieldFileExcludeExtens = "RX"
+	adcFieldSudpKey           = "KY"
 )
 
 const (
@@ -87,6 +93,7 @@ const (
 
 const (
 	adcCodeProtocolUnsupported = 41
+	adcCodeTransferGeneric     = 50
 	adcCodeFileNotAvailable    = 51
 	adcCodeSlotsFull           = 53
 )
@@ -133,6 +140,18 @@ func adcFieldsDecode(in string) map[string]string {
 	return ret
 }
 
+// adcFieldsDecodeMulti decodes fields that can be repeated.
+func adcFieldsDecodeMulti(in string) map[string][]string {
+	ret := make(map[string][]string)
+	for _, arg := range strings.Split(in, " ") {
+		if len(arg) < 2 {
+			continue
+		}
+		ret[arg[:2]] = append(ret[arg[:2]], adcUnescape(arg[2:]))
+	}
+	return ret
+}
+
 func adcFieldsEncode(fields map[string]string) string {
 	var out []string
 	for key, val := range fields {
@@ -197,6 +216,10 @@ func (p *protocolAdc) Read() (msgDecodable, error) {
 					return &msgAdcCGetFile{}
 				case "CINF":
 					return &msgAdcCInfos{}
+				case "CMSG":
+					return &msgAdcCMessage{}
+				case "CPMI":
+					return &msgAdcCPrivateMessageInfos{}
 				case "CSND":
 					return &msgAdcCSendFile{}
 				case "CSUP":
@@ -485,14 +508,14 @@ func (m *msgAdcKeyGetFile) AdcKeyDecode(args string) error {
 	if matches == nil {
 		return errorArgsFormat
 	}
-	m.Query, m.Start, m.Length, m.Compressed = matches[1], atoui64(matches[4]),
-		atoi64(matches[5]), (matches[6] != "")
+	m.Query, m.Start, m.Length, m.Compressed = dcQueryDecode(matches), atoui64(matches[5]),
+		atoi64(matches[6]), (matches[7] != "")
 	return nil
 }
 
 func (m *msgAdcKeyGetFile) AdcKeyEncode() string {
 	return "GET" + fmt.Sprintf("%s %d %d%s",
-		m.Query, m.Start, m.Length,
+		dcQueryEncode(m.Query), m.Start, m.Length,
 		func() string {
 			if m.Compressed == true {
 				return " ZL1"
@@ -557,6 +580,19 @@ func (m *msgAdcKeyPass) AdcKeyEncode() string {
 	return "PAS" + dcBase32Encode(m.Data)
 }
 
+type msgAdcKeyPrivateMessageInfos struct {
+	Fields map[string]string
+}
+
+func (m *msgAdcKeyPrivateMessageInfos) AdcKeyDecode(args string) error {
+	m.Fields = adcFieldsDecode(args)
+	return nil
+}
+
+func (m *msgAdcKeyPrivateMessageInfos) AdcKeyEncode() string {
+	return "PMI" + adcFieldsEncode(m.Fields)
+}
+
 type msgAdcKeyQuit struct {
 	SessionId string
 	Reason    string
@@ -591,10 +627,13 @@ func (m *msgAdcKeyRevConnectToMe) AdcKeyDecode(args string) error {
 
 type msgAdcKeySearchRequest struct {
 	Fields map[string]string
+	// all the values of the fields, since some of them can be repeated
+	MultiFields map[string][]string
 }
 
 func (m *msgAdcKeySearchRequest) AdcKeyDecode(args string) error {
 	m.Fields = adcFieldsDecode(args)
+	m.MultiFields = adcFieldsDecodeMulti(args)
 	return nil
 }
 
@@ -627,14 +666,14 @@ func (m *msgAdcKeySendFile) AdcKeyDecode(args string) error {
 	if matches == nil {
 		return errorArgsFormat
 	}
-	m.Query, m.Start, m.Length, m.Compressed = matches[1], atoui64(matches[4]),
-		atoui64(matches[5]), (matches[6] != "")
+	m.Query, m.Start, m.Length, m.Compressed = dcQueryDecode(matches), atoui64(matches[5]),
+		atoui64(matches[6]), (matches[7] != "")
 	return nil
 }
 
 func (m *msgAdcKeySendFile) AdcKeyEncode() string {
 	return "SND" + fmt.Sprintf("%s %d %d%s",
-		m.Query, m.Start, m.Length,
+		dcQueryEncode(m.Query), m.Start, m.Length,
 		func() string {
 			if m.Compressed {
 				return " ZL1"
@@ -739,6 +778,16 @@ type msgAdcCInfos struct {
 	msgAdcKeyInfos
 }
 
+type msgAdcCMessage struct {
+	msgAdcTypeC
+	msgAdcKeyMessage
+}
+
+type msgAdcCPrivateMessageInfos struct {
+	msgAdcTypeC
+	msgAdcKeyPrivateMessageInfos
+}
+
 type msgAdcCSendFile struct {
 	msgAdcTypeC
 	msgAdcKeySendFile
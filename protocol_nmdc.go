@@ -32,12 +32,14 @@ var reNmdcPrivateChat = regexp.MustCompile("(?s)^\\$To: (" + reStrNick + ") From
 var reNmdcCmdConnectToMe = regexp.MustCompile("^(" + reStrNick + ") (" + reStrIp + "):(" + reStrPort + ")(S?)$")
 var reNmdcCmdDirection = regexp.MustCompile("^(Download|Upload) ([0-9]+)$")
 var reNmdcCmdForceMove = regexp.MustCompile("^(" + reStrAddress + ")(:(" + reStrPort + "))?$")
+var reNmdcCmdGet = regexp.MustCompile("^(.+)\\$([0-9]+)$")
 var reNmdcCmdInfo = regexp.MustCompile("^\\$ALL (" + reStrNick + ") (.*?)(<(.*?) V:(.+?),M:(A|P),H:([0-9]+)/([0-9]+)/([0-9]+),S:([0-9]+)>)?\\$ \\$(.*?)(.)\\$(.*?)\\$([0-9]+)\\$$")
 var reNmdcCmdLock = regexp.MustCompile("^([^ ]+)( Pk=(.+?)(Ref=(.+?))?)?$")
 var reNmdcCmdRevConnectToMe = regexp.MustCompile("^(" + reStrNick + ") (" + reStrNick + ")$")
 var reNmdcCmdSearchReqActive = regexp.MustCompile("^(" + reStrIp + "):(" + reStrPort + ") (F|T)\\?(F|T)\\?([0-9]+)\\?([0-9])\\?(.+)$")
 var reNmdcCmdSearchReqPassive = regexp.MustCompile("^Hub:(" + reStrNick + ") (F|T)\\?(F|T)\\?([0-9]+)\\?([0-9])\\?(.+)$")
 var reNmdcCmdSearchResult = regexp.MustCompile("^(" + reStrNick + ") ([^\x05]+?)(\x05([0-9]+))? ([0-9]+)/([0-9]+)\x05(TTH:(" + reStrTTH + ")|(.+?)) \\((" + reStrIp + "):(" + reStrPort + ")\\)$")
+var reNmdcCmdUGetBlock = regexp.MustCompile("^([0-9]+) (-1|[0-9]+) (.+)$")
 var reNmdcCmdUserCommand = regexp.MustCompile("^([0-9]{1,3}) ([0-9]{1,2}) (.*?)$")
 var reNmdcCmdUserIP = regexp.MustCompile("^(" + reStrNick + ") (" + reStrIp + ")$")
 
@@ -75,6 +77,23 @@ func nmdcComputeKey(lock []byte) []byte {
 	return res
 }
 
+// legacy transfer commands ($Get, $UGetBlock) use paths without the leading
+// slash and with backslashes as separators
+func nmdcPathEncode(in string) string {
+	return strings.Replace(strings.TrimPrefix(in, "/"), "/", "\\", -1)
+}
+
+func nmdcPathDecode(in string) string {
+	return "/" + strings.Replace(in, "\\", "/", -1)
+}
+
+func nmdcLegacyQuery(in string) string {
+	if in == "files.xml.bz2" {
+		return "file files.xml.bz2"
+	}
+	return "file " + nmdcPathDecode(in)
+}
+
 func nmdcCommandEncode(key string, args string) string {
 	return "$" + key + " " + args + "|"
 }
@@ -123,8 +142,14 @@ func (p *protocolNmdc) Read() (msgDecodable, error) {
 						return &msgNmdcDirection{}
 					case "Error":
 						return &msgNmdcError{}
+					case "Failed":
+						return &msgNmdcFailed{}
+					case "FileLength":
+						return &msgNmdcFileLength{}
 					case "ForceMove":
 						return &msgNmdcForceMove{}
+					case "Get":
+						return &msgNmdcGet{}
 					case "GetPass":
 						return &msgNmdcGetPass{}
 					case "Hello":
@@ -157,8 +182,14 @@ func (p *protocolNmdc) Read() (msgDecodable, error) {
 						return &msgNmdcSearchRequest{}
 					case "SR":
 						return &msgNmdcSearchResult{}
+					case "Send":
+						return &msgNmdcSend{}
+					case "Sending":
+						return &msgNmdcSending{}
 					case "Supports":
 						return &msgNmdcSupports{}
+					case "UGetBlock":
+						return &msgNmdcUGetBlock{}
 					case "UserCommand":
 						return &msgNmdcUserCommand{}
 					case "UserIP":
@@ -236,14 +267,14 @@ func (m *msgNmdcGetFile) NmdcDecode(args string) error {
 	if matches == nil {
 		return errorArgsFormat
 	}
-	m.Query, m.Start, m.Length, m.Compressed = matches[1], atoui64(matches[4]),
-		atoi64(matches[5]), (matches[6] != "")
+	m.Query, m.Start, m.Length, m.Compressed = dcQueryDecode(matches), atoui64(matches[5]),
+		atoi64(matches[6]), (matches[7] != "")
 	return nil
 }
 
 func (m *msgNmdcGetFile) NmdcEncode() string {
 	return nmdcCommandEncode("ADCGET", fmt.Sprintf("%s %d %d%s",
-		m.Query, m.Start, m.Length,
+		dcQueryEncode(m.Query), m.Start, m.Length,
 		func() string {
 			if m.Compressed == true {
 				return " ZL1"
@@ -264,14 +295,14 @@ func (m *msgNmdcSendFile) NmdcDecode(args string) error {
 	if matches == nil {
 		return errorArgsFormat
 	}
-	m.Query, m.Start, m.Length, m.Compressed = matches[1], atoui64(matches[4]),
-		atoui64(matches[5]), (matches[6] != "")
+	m.Query, m.Start, m.Length, m.Compressed = dcQueryDecode(matches), atoui64(matches[5]),
+		atoui64(matches[6]), (matches[7] != "")
 	return nil
 }
 
 func (m *msgNmdcSendFile) NmdcEncode() string {
 	return nmdcCommandEncode("ADCSND", fmt.Sprintf("%s %d %d%s",
-		m.Query, m.Start, m.Length,
+		dcQueryEncode(m.Query), m.Start, m.Length,
 		func() string {
 			if m.Compressed {
 				return " ZL1"
@@ -357,6 +388,32 @@ func (m *msgNmdcError) NmdcEncode() string {
 	return nmdcCommandEncode("Error", m.Error)
 }
 
+type msgNmdcFailed struct {
+	Error string
+}
+
+func (m *msgNmdcFailed) NmdcDecode(args string) error {
+	m.Error = args
+	return nil
+}
+
+func (m *msgNmdcFailed) NmdcEncode() string {
+	return nmdcCommandEncode("Failed", m.Error)
+}
+
+type msgNmdcFileLength struct {
+	Length uint64
+}
+
+func (m *msgNmdcFileLength) NmdcDecode(args string) error {
+	m.Length = atoui64(args)
+	return nil
+}
+
+func (m *msgNmdcFileLength) NmdcEncode() string {
+	return nmdcCommandEncode("FileLength", numtoa(m.Length))
+}
+
 type msgNmdcForceMove struct {
 	Address string
 	Port    uint
@@ -371,6 +428,24 @@ func (m *msgNmdcForceMove) NmdcDecode(args string) error {
 	return nil
 }
 
+type msgNmdcGet struct {
+	Path   string
+	Offset uint64 // starts from 1
+}
+
+func (m *msgNmdcGet) NmdcDecode(args string) error {
+	matches := reNmdcCmdGet.FindStringSubmatch(args)
+	if matches == nil {
+		return errorArgsFormat
+	}
+	m.Path, m.Offset = matches[1], atoui64(matches[2])
+	return nil
+}
+
+func (m *msgNmdcGet) NmdcEncode() string {
+	return nmdcCommandEncode("Get", fmt.Sprintf("%s$%d", m.Path, m.Offset))
+}
+
 type msgNmdcGetNickList struct{}
 
 func (m *msgNmdcGetNickList) NmdcEncode() string {
@@ -756,6 +831,29 @@ func (m *msgNmdcSearchResult) NmdcEncode() string {
 		}()))
 }
 
+type msgNmdcSend struct{}
+
+func (m *msgNmdcSend) NmdcDecode(args string) error {
+	return nil
+}
+
+func (m *msgNmdcSend) NmdcEncode() string {
+	return nmdcCommandEncode("Send", "")
+}
+
+type msgNmdcSending struct {
+	Length uint64
+}
+
+func (m *msgNmdcSending) NmdcDecode(args string) error {
+	m.Length = atoui64(args)
+	return nil
+}
+
+func (m *msgNmdcSending) NmdcEncode() string {
+	return nmdcCommandEncode("Sending", numtoa(m.Length))
+}
+
 type msgNmdcSupports struct {
 	Features map[string]struct{}
 }
@@ -776,6 +874,25 @@ func (m *msgNmdcSupports) NmdcEncode() string {
 	return nmdcCommandEncode("Supports", strings.Join(ret, " "))
 }
 
+type msgNmdcUGetBlock struct {
+	Start  uint64
+	Length int64
+	Path   string
+}
+
+func (m *msgNmdcUGetBlock) NmdcDecode(args string) error {
+	matches := reNmdcCmdUGetBlock.FindStringSubmatch(args)
+	if matches == nil {
+		return errorArgsFormat
+	}
+	m.Start, m.Length, m.Path = atoui64(matches[1]), atoi64(matches[2]), matches[3]
+	return nil
+}
+
+func (m *msgNmdcUGetBlock) NmdcEncode() string {
+	return nmdcCommandEncode("UGetBlock", fmt.Sprintf("%d %d %s", m.Start, m.Length, m.Path))
+}
+
 type msgNmdcUserCommand struct{}
 
 func (m *msgNmdcUserCommand) NmdcDecode(args string) error {
@@ -2,7 +2,9 @@ package dctoolkit
 
 import (
 	"fmt"
+	"path"
 	"strings"
+	"time"
 )
 
 // SearchType contains the search type.
@@ -17,6 +19,60 @@ const (
 	SearchTTH
 )
 
+// SearchPriority contains the priority of a search in the outgoing queue.
+type SearchPriority int
+
+const (
+	// SearchPriorityNormal is used for searches started by the user
+	SearchPriorityNormal SearchPriority = iota
+	// SearchPriorityLow is used for automatic searches, like the ones of
+	// alternate sources for downloads
+	SearchPriorityLow
+)
+
+// FileType contains a category of files, that can be used to restrict a search.
+type FileType int
+
+const (
+	// FileTypeAny matches every file
+	FileTypeAny FileType = iota
+	// FileTypeAudio matches audio files (mp3, flac, ...)
+	FileTypeAudio
+	// FileTypeCompressed matches archives (zip, rar, ...)
+	FileTypeCompressed
+	// FileTypeDocument matches documents (pdf, txt, ...)
+	FileTypeDocument
+	// FileTypeExecutable matches executables (exe, msi, ...)
+	FileTypeExecutable
+	// FileTypePicture matches pictures (jpg, png, ...)
+	FileTypePicture
+	// FileTypeVideo matches videos (mkv, avi, ...)
+	FileTypeVideo
+)
+
+// extensions of every file type. They are the same of the ADC extension groups.
+var fileTypeExtensions = map[FileType][]string{
+	FileTypeAudio:      {"ape", "flac", "m4a", "mid", "mp3", "mpc", "ogg", "ra", "wav", "wma"},
+	FileTypeCompressed: {"7z", "ace", "arj", "bz2", "gz", "lha", "lzh", "rar", "tar", "tz", "z", "zip"},
+	FileTypeDocument: {"doc", "docx", "htm", "html", "nfo", "odf", "odp", "ods", "odt", "pdf", "ppt", "pptx",
+		"rtf", "txt", "xls", "xlsx", "xml", "xps"},
+	FileTypeExecutable: {"app", "bat", "cmd", "com", "dll", "exe", "jar", "msi", "ps1", "vbs", "wsf"},
+	FileTypePicture: {"bmp", "cdr", "eps", "gif", "ico", "img", "jpeg", "jpg", "png", "ps", "psd", "sfw",
+		"tga", "tif", "webp"},
+	FileTypeVideo: {"3gp", "asf", "asx", "avi", "divx", "flv", "mkv", "mov", "mp4", "mpeg", "mpg", "ogm",
+		"pxp", "qt", "rm", "rmvb", "swf", "vob", "webm", "wmv"},
+}
+
+var fileTypeByExtension = func() map[string]FileType {
+	ret := make(map[string]FileType)
+	for ftype, exts := range fileTypeExtensions {
+		for _, ext := range exts {
+			ret[ext] = ftype
+		}
+	}
+	return ret
+}()
+
 // SearchResult contains a single result received after a search request.
 type SearchResult struct {
 	// whether the search result was received in passive or active mode
@@ -39,6 +95,9 @@ type SearchResult struct {
 type SearchConf struct {
 	// the search type, defaults to SearchAny. See SearchType for all the available options
 	Type SearchType
+	// the type of the searched file (if type is SearchAny), defaults to FileTypeAny.
+	// See FileType for all the available options
+	FileType FileType
 	// the minimum size of the searched file (if type is SearchAny or SearchTTH)
 	MinSize uint64
 	// the maximum size of the searched file (if type is SearchAny or SearchTTH)
@@ -48,104 +107,307 @@ type SearchConf struct {
 	Query string
 	// file TTH (if type is SearchTTH)
 	TTH TigerHash
+	// how long the search session collects results, starting from when the
+	// search is sent. It defaults to 30 seconds
+	Timeout time.Duration
+	// the priority of the search in the outgoing queue, defaults to
+	// SearchPriorityNormal. See SearchPriority for all the available options
+	Priority SearchPriority
 }
 
 type searchIncomingRequest struct {
-	isActive bool
-	stype    SearchType
-	minSize  uint64
-	maxSize  uint64
-	query    string    // if type is SearchAny or SearchDirectory
-	tth      TigerHash // if type is SearchTTH
+	peer      *Peer // nil if the author is unknown
+	isActive  bool
+	stype     SearchType
+	fileOnly  bool // ADC only
+	fileType  FileType
+	minSize   uint64
+	maxSize   uint64
+	exactSize uint64 // ADC only
+	// if type is SearchAny or SearchDirectory
+	terms              []string  // all of them must be contained in the path
+	excluded           []string  // none of them must be contained in the path (ADC only)
+	extensions         []string  // ADC only
+	excludedExtensions []string  // ADC only
+	tth                TigerHash // if type is SearchTTH
 }
 
-// Search starts a file search asynchronously. See SearchConf for the available options.
-func (c *Client) Search(conf SearchConf) error {
-	if c.protoIsAdc == true {
-		return c.handleAdcSearchOutgoingRequest(conf)
-	} else {
-		return c.handleNmdcSearchOutgoingRequest(conf)
+// normalize converts terms and extensions into the format used for matching.
+func (req *searchIncomingRequest) normalize() {
+	normalize := func(in []string, isExtension bool) []string {
+		var ret []string
+		for _, val := range in {
+			val = strings.ToLower(val)
+			if isExtension == true {
+				val = strings.TrimPrefix(val, ".")
+			}
+			ret = append(ret, val)
+		}
+		return ret
+	}
+	req.terms = normalize(req.terms, false)
+	req.excluded = normalize(req.excluded, false)
+	req.extensions = normalize(req.extensions, true)
+	req.excludedExtensions = normalize(req.excludedExtensions, true)
+}
+
+// isExcluded returns whether a path contains an excluded term.
+func (req *searchIncomingRequest) isExcluded(apath string) bool {
+	apath = strings.ToLower(apath)
+	for _, term := range req.excluded {
+		if strings.Contains(apath, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// dirMatches returns whether directories can be returned, that happens only
+// if no file filter is set.
+func (req *searchIncomingRequest) dirMatches() bool {
+	return req.fileOnly == false && len(req.extensions) == 0 && req.fileType == FileTypeAny
+}
+
+// fileMatches returns whether a file satisfies the filters of the request,
+// except terms.
+func (req *searchIncomingRequest) fileMatches(apath string, size uint64) bool {
+	if req.stype == SearchDirectory ||
+		(req.minSize != 0 && size < req.minSize) ||
+		(req.maxSize != 0 && size > req.maxSize) ||
+		(req.exactSize != 0 && size != req.exactSize) {
+		return false
+	}
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(apath)), ".")
+	if len(req.extensions) > 0 && stringInSlice(ext, req.extensions) == false {
+		return false
+	}
+	if stringInSlice(ext, req.excludedExtensions) == true {
+		return false
+	}
+	if req.fileType != FileTypeAny && fileTypeByExtension[ext] != req.fileType {
+		return false
+	}
+	return req.isExcluded(apath) == false
+}
+
+// SearchRequest contains a search request received from a peer.
+type SearchRequest struct {
+	// the peer that sent the request, or nil if unknown
+	Peer *Peer
+	// whether the request was sent in active mode
+	IsActive bool
+	// the search type
+	Type SearchType
+	// the type of the searched file (if type is SearchAny)
+	FileType FileType
+	// words that must be contained in the path (if type is SearchAny or SearchDirectory)
+	Query string
+	// words that must not be contained in the path (ADC only)
+	Excluded []string
+	// allowed file extensions (ADC only)
+	Extensions []string
+	// the minimum size of the searched file
+	MinSize uint64
+	// the maximum size of the searched file
+	MaxSize uint64
+	// the exact size of the searched file (ADC only)
+	ExactSize uint64
+	// file TTH (if type is SearchTTH)
+	TTH TigerHash
+	// whether the request is answered. Requests dropped by the rate limiter,
+	// or whose results would be sent to an unverified ip, are reported too,
+	// but their results are not sent
+	Answered bool
+
+	results []searchIncomingResult
+}
+
+// AddResult adds a result that is sent to the requester together with the
+// files of the share. path is in the same format of SearchResult.Path, i.e.
+// /alias/directory/file. size and tth are ignored for directories in NMDC.
+func (r *SearchRequest) AddResult(path string, isDir bool, size uint64, tth TigerHash) {
+	r.results = append(r.results, searchIncomingResult{
+		path:  path,
+		isDir: isDir,
+		size:  size,
+		tth:   tth,
+	})
+}
+
+// searchIncomingResult is a result sent in reply to an incoming search.
+type searchIncomingResult struct {
+	path  string
+	isDir bool
+	size  uint64 // in case of directories, the size of their content (ADC only)
+	tth   TigerHash
+}
+
+// handleSearchIncomingRequest reports a request to OnSearchRequest and
+// returns its results. dropErr is the reason why the request must not be
+// answered, if any.
+func (c *Client) handleSearchIncomingRequest(req *searchIncomingRequest, dropErr error) ([]searchIncomingResult, error) {
+	// Implementations should send a maximum of 5 search results to passive users
+	// and 10 search results to active users
+	maxResults := func() int {
+		if req.isActive == true {
+			return 10
+		}
+		return 5
+	}()
+
+	sreq := &SearchRequest{
+		Peer:       req.peer,
+		IsActive:   req.isActive,
+		Type:       req.stype,
+		FileType:   req.fileType,
+		Query:      strings.Join(req.terms, " "),
+		Excluded:   req.excluded,
+		Extensions: req.extensions,
+		MinSize:    req.minSize,
+		MaxSize:    req.maxSize,
+		ExactSize:  req.exactSize,
+		TTH:        req.tth,
+		Answered:   (dropErr == nil),
+	}
+	if c.OnSearchRequest != nil {
+		c.OnSearchRequest(sreq)
+	}
+	if dropErr != nil {
+		return nil, dropErr
+	}
+
+	shared, err := c.searchShare(req, maxResults)
+	if err != nil && len(sreq.results) == 0 {
+		return nil, err
+	}
+
+	var results []searchIncomingResult
+	for _, res := range shared {
+		switch o := res.(type) {
+		case *shareFile:
+			results = append(results, searchIncomingResult{
+				path: o.aliasPath,
+				size: o.size,
+				tth:  o.tth,
+			})
+
+		case *shareDirectory:
+			results = append(results, searchIncomingResult{
+				path:  o.aliasPath,
+				isDir: true,
+				size:  c.shareIndex.dirSize[o],
+			})
+		}
+	}
+	for _, res := range sreq.results {
+		if len(results) >= maxResults {
+			break
+		}
+		results = append(results, res)
 	}
+
+	dolog(LevelInfo, "[search] req: %+v | sent %d results", req, len(results))
+	return results, nil
 }
 
-func (c *Client) handleSearchIncomingRequest(req *searchIncomingRequest) ([]interface{}, error) {
+// searchShare returns the shared files and directories that match a request.
+func (c *Client) searchShare(req *searchIncomingRequest, maxResults int) ([]interface{}, error) {
 	var results []interface{}
-	var scanDir func(dname string, dir *shareDirectory, dirAddToResults bool)
+	visible := make(map[string]bool)
+	isVisible := func(alias string) bool {
+		if _, ok := visible[alias]; !ok {
+			visible[alias] = c.shareRootVisible(alias, req.peer)
+		}
+		return visible[alias]
+	}
 
 	// search file or directory by name
 	if req.stype == SearchAny || req.stype == SearchDirectory {
-		if len(req.query) < 3 {
-			return nil, fmt.Errorf("query too short: %s", req.query)
-		}
-
-		// normalize query
-		req.query = strings.ToLower(req.query)
+		req.normalize()
 
-		scanDir = func(dname string, dir *shareDirectory, dirAddToResults bool) {
-			// always add directories
-			if dirAddToResults == false {
-				dirAddToResults = strings.Contains(strings.ToLower(dname), req.query)
-			}
-			if dirAddToResults {
-				results = append(results, dir)
+		longestTerm := ""
+		for _, term := range req.terms {
+			if len(term) > len(longestTerm) {
+				longestTerm = term
 			}
+		}
+		// typed searches without extensions look for all the extensions of the type
+		searchExtensions := req.extensions
+		if len(searchExtensions) == 0 {
+			searchExtensions = fileTypeExtensions[req.fileType]
+		}
+		if len(longestTerm) < 3 && len(searchExtensions) == 0 {
+			return nil, fmt.Errorf("query too short: %v", req.terms)
+		}
 
-			if req.stype != SearchDirectory {
-				for fname, file := range dir.files {
-					fileAddToResults := dirAddToResults
-					if fileAddToResults == false {
-						fileAddToResults = strings.Contains(strings.ToLower(fname), req.query) &&
-							(req.minSize == 0 || file.size > req.minSize) &&
-							(req.maxSize == 0 || file.size < req.maxSize)
+		fileMatches := func(file *shareFile) bool {
+			return req.fileMatches(file.aliasPath, file.size)
+		}
+
+		// search by extension only
+		if len(req.terms) == 0 {
+			for _, ext := range searchExtensions {
+				for _, id := range c.shareIndex.byExtension[ext] {
+					if len(results) >= maxResults {
+						break
 					}
-					if fileAddToResults {
-						results = append(results, file)
+					entry := c.shareIndex.entries[id]
+					if isVisible(entry.alias) == true && fileMatches(entry.file) == true {
+						results = append(results, entry.file)
 					}
 				}
 			}
 
-			for sname, sdir := range dir.dirs {
-				scanDir(sname, sdir, dirAddToResults)
-			}
+		} else {
+			c.shareIndex.match(req.terms, func(id uint32) bool {
+				entry := c.shareIndex.entries[id]
+				if isVisible(entry.alias) == false {
+					return true
+				}
+
+				if entry.dir != nil {
+					if req.dirMatches() == true && req.isExcluded(entry.dir.aliasPath) == false {
+						results = append(results, entry.dir)
+					}
+				} else if fileMatches(entry.file) == true {
+					results = append(results, entry.file)
+				}
+				return len(results) < maxResults
+			})
 		}
 
 		// search file by TTH
 	} else {
-		scanDir = func(dname string, dir *shareDirectory, dirAddToResults bool) {
-			for _, file := range dir.files {
-				if file.tth == req.tth {
-					results = append(results, file)
-				}
+		for _, id := range c.shareIndex.byTTH[req.tth] {
+			if len(results) >= maxResults {
+				break
 			}
-			for sname, sdir := range dir.dirs {
-				scanDir(sname, sdir, false)
+			entry := c.shareIndex.entries[id]
+			if isVisible(entry.alias) == true {
+				results = append(results, entry.file)
 			}
 		}
 	}
 
-	// start searching
-	for alias, dir := range c.shareTree {
-		scanDir(alias, dir, false)
-	}
-
-	// Implementations should send a maximum of 5 search results to passive users
-	// and 10 search results to active users
-	if req.isActive == true {
-		if len(results) > 10 {
-			results = results[:10]
-		}
-	} else {
-		if len(results) > 5 {
-			results = results[:5]
-		}
-	}
-
-	dolog(LevelInfo, "[search] req: %+v | sent %d results", req, len(results))
 	return results, nil
 }
 
-func (c *Client) handleSearchResult(sr *SearchResult) {
+// handleSearchResult routes a result to the search sessions. token is the
+// token of the search (ADC only), or an empty string.
+func (c *Client) handleSearchResult(sr *SearchResult, token string) {
 	dolog(LevelInfo, "[search] res: %+v", sr)
+
+	for s := range c.searchSessions {
+		if token != "" {
+			if s.token != token {
+				continue
+			}
+		} else if s.matches(sr) == false {
+			continue
+		}
+		s.handleResult(sr)
+	}
+
 	if c.OnSearchResult != nil {
 		c.OnSearchResult(sr)
 	}
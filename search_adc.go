@@ -2,7 +2,6 @@ package dctoolkit
 
 import (
 	"fmt"
-	"net"
 	"strings"
 )
 
@@ -11,11 +10,28 @@ const (
 	adcSearchDirectory = "2"
 )
 
+// adcFileGroup returns the extension group (SEGA) of a file type.
+func adcFileGroup(ftype FileType) uint64 {
+	return 1 << uint(ftype-1)
+}
+
+// adcFileGroupExtensions returns the extensions of the given extension groups.
+func adcFileGroupExtensions(groups uint64) []string {
+	var ret []string
+	for ftype := FileTypeAudio; ftype <= FileTypeVideo; ftype++ {
+		if groups&adcFileGroup(ftype) != 0 {
+			ret = append(ret, fileTypeExtensions[ftype]...)
+		}
+	}
+	return ret
+}
+
 func (c *Client) handleAdcSearchResult(isActive bool, peer *Peer, msg *msgAdcKeySearchResult) {
 	sr := &SearchResult{
 		IsActive: isActive,
 		Peer:     peer,
 	}
+	token := ""
 
 	for key, val := range msg.Fields {
 		switch key {
@@ -35,24 +51,33 @@ func (c *Client) handleAdcSearchResult(isActive bool, peer *Peer, msg *msgAdcKey
 			}
 		case adcFieldUploadSlotCount:
 			sr.SlotAvail = atoui(val)
+		case adcFieldToken:
+			token = val
 		}
 	}
 	if sr.IsDir == true {
 		sr.Path = strings.TrimSuffix(sr.Path, "/")
 	}
 
-	c.handleSearchResult(sr)
+	c.handleSearchResult(sr, token)
 }
 
-func (c *Client) handleAdcSearchOutgoingRequest(conf SearchConf) error {
+func (c *Client) handleAdcSearchOutgoingRequest(conf SearchConf, token string, sudpKey []byte) {
 	fields := make(map[string]string)
 
-	// always add token even if we're not using it
-	fields[adcFieldToken] = adcRandomToken()
+	// the token is used to route results to the search session
+	fields[adcFieldToken] = token
+
+	if sudpKey != nil {
+		fields[adcFieldSudpKey] = dcBase32Encode(sudpKey)
+	}
 
 	switch conf.Type {
 	case SearchAny:
 		fields[adcFieldQueryAnd] = conf.Query
+		if conf.FileType != FileTypeAny {
+			fields[adcFieldFileGroup] = numtoa(adcFileGroup(conf.FileType))
+		}
 
 	case SearchDirectory:
 		fields[adcFieldIsFileOrDir] = adcSearchDirectory
@@ -83,52 +108,37 @@ func (c *Client) handleAdcSearchOutgoingRequest(conf SearchConf) error {
 	if len(requiredFeatures) > 0 {
 		c.connHub.conn.Write(&msgAdcFSearchRequest{
 			msgAdcTypeF{SessionId: c.sessionId, RequiredFeatures: requiredFeatures},
-			msgAdcKeySearchRequest{fields},
+			msgAdcKeySearchRequest{Fields: fields},
 		})
 	} else {
 		c.connHub.conn.Write(&msgAdcBSearchRequest{
 			msgAdcTypeB{c.sessionId},
-			msgAdcKeySearchRequest{fields},
+			msgAdcKeySearchRequest{Fields: fields},
 		})
 	}
-	return nil
 }
 
 func (c *Client) handleAdcSearchIncomingRequest(authorSessionId string, req *msgAdcKeySearchRequest) {
 	var peer *Peer
-	results, err := func() ([]interface{}, error) {
+	results, err := func() ([]searchIncomingResult, error) {
 		peer = c.peerBySessionId(authorSessionId)
 		if peer == nil {
 			return nil, fmt.Errorf("search author not found")
 		}
 
-		if _, ok := req.Fields[adcFieldFileGroup]; ok {
-			return nil, fmt.Errorf("search by type is not supported")
-		}
-		if _, ok := req.Fields[adcFieldFileExcludeExtens]; ok {
-			return nil, fmt.Errorf("search by type is not supported")
-		}
-		if _, ok := req.Fields[adcFieldFileQueryOr]; ok {
-			return nil, fmt.Errorf("search by query OR is not supported")
-		}
-		if _, ok := req.Fields[adcFieldFileExactSize]; ok {
-			return nil, fmt.Errorf("search by exact size is not supported")
-		}
-		if _, ok := req.Fields[adcFieldFileExtension]; ok {
-			return nil, fmt.Errorf("search by extension is not supported")
-		}
-		if _, ok := req.Fields[adcFieldIsFileOrDir]; ok {
-			if req.Fields[adcFieldIsFileOrDir] != adcSearchDirectory {
-				return nil, fmt.Errorf("search file only is not supported")
-			}
-		}
-		if _, ok := req.Fields[adcFieldQueryAnd]; !ok {
-			if _, ok := req.Fields[adcFieldFileTTH]; !ok {
-				return nil, fmt.Errorf("AN or TR is required")
+		if func() bool {
+			for _, key := range []string{adcFieldQueryAnd, adcFieldFileTTH, adcFieldFileExtension, adcFieldFileGroup} {
+				if _, ok := req.Fields[key]; ok {
+					return true
+				}
 			}
+			return false
+		}() == false {
+			return nil, fmt.Errorf("AN, TR, EX or GR is required")
 		}
 
 		sr := &searchIncomingRequest{
+			peer:     peer,
 			isActive: (peer.IsPassive == false),
 			stype: func() SearchType {
 				if _, ok := req.Fields[adcFieldFileTTH]; ok {
@@ -141,6 +151,7 @@ func (c *Client) handleAdcSearchIncomingRequest(authorSessionId string, req *msg
 				}
 				return SearchAny
 			}(),
+			fileOnly: (req.Fields[adcFieldIsFileOrDir] == adcSearchFile),
 			minSize: func() uint64 {
 				if val, ok := req.Fields[adcFieldMinSize]; ok {
 					return atoui64(val)
@@ -153,6 +164,21 @@ func (c *Client) handleAdcSearchIncomingRequest(authorSessionId string, req *msg
 				}
 				return 0
 			}(),
+			exactSize: func() uint64 {
+				if val, ok := req.Fields[adcFieldFileExactSize]; ok {
+					return atoui64(val)
+				}
+				return 0
+			}(),
+			excluded:           req.MultiFields[adcFieldFileQueryOr],
+			excludedExtensions: req.MultiFields[adcFieldFileExcludeExtens],
+			extensions: func() []string {
+				ret := req.MultiFields[adcFieldFileExtension]
+				if val, ok := req.Fields[adcFieldFileGroup]; ok {
+					ret = append(ret, adcFileGroupExtensions(atoui64(val))...)
+				}
+				return ret
+			}(),
 		}
 
 		if _, ok := req.Fields[adcFieldFileTTH]; ok {
@@ -163,10 +189,14 @@ func (c *Client) handleAdcSearchIncomingRequest(authorSessionId string, req *msg
 			}
 
 		} else {
-			sr.query = req.Fields[adcFieldQueryAnd]
+			sr.terms = req.MultiFields[adcFieldQueryAnd]
 		}
 
-		return c.handleSearchIncomingRequest(sr)
+		// results of active peers are sent to the ip advertised by the hub
+		dropErr := c.searchLimiter.allow("sid:"+authorSessionId,
+			peer.IsPassive == true || (peer.Ip != "" && peer.adcUdpPort != 0))
+
+		return c.handleSearchIncomingRequest(sr, dropErr)
 	}()
 	if err != nil {
 		dolog(LevelDebug, "[search] error: %s", err)
@@ -179,18 +209,15 @@ func (c *Client) handleAdcSearchIncomingRequest(authorSessionId string, req *msg
 			adcFieldUploadSlotCount: numtoa(c.conf.UploadMaxParallel),
 		}
 
-		switch o := res.(type) {
-		case *shareFile:
-			fields[adcFieldFilePath] = o.aliasPath
-			fields[adcFieldFileTTH] = o.tth.String()
-			fields[adcFieldSize] = numtoa(o.size)
-
-		case *shareDirectory:
+		if res.isDir == false {
+			fields[adcFieldFilePath] = res.path
+			fields[adcFieldFileTTH] = res.tth.String()
+		} else {
 			// if directory, add a trailing slash
-			fields[adcFieldFilePath] = o.aliasPath + "/"
+			fields[adcFieldFilePath] = res.path + "/"
 			fields[adcFieldFileTTH] = dirTTH
-			fields[adcFieldSize] = numtoa(o.size)
 		}
+		fields[adcFieldSize] = numtoa(res.size)
 
 		// add token if sent by author
 		if val, ok := req.Fields[adcFieldToken]; ok {
@@ -202,21 +229,36 @@ func (c *Client) handleAdcSearchIncomingRequest(authorSessionId string, req *msg
 
 	// send to peer
 	if peer.IsPassive == false {
-		go func() {
-			conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", peer.Ip, peer.adcUdpPort))
-			if err != nil {
-				return
+		// encrypt results if the author sent a key (SUDP)
+		sudpKey := func() []byte {
+			if val, ok := req.Fields[adcFieldSudpKey]; ok {
+				if key := dcBase32Decode(val); len(key) == _SUDP_KEY_SIZE {
+					return key
+				}
 			}
-			defer conn.Close()
+			return nil
+		}()
 
-			for _, msg := range msgs {
-				encmsg := &msgAdcUSearchResult{
-					msgAdcTypeU{peer.adcClientId},
-					*msg,
+		var encmsgs [][]byte
+		for _, msg := range msgs {
+			encmsg := &msgAdcUSearchResult{
+				msgAdcTypeU{peer.adcClientId},
+				*msg,
+			}
+			buf := []byte(encmsg.AdcTypeEncode(encmsg.AdcKeyEncode()))
+			if sudpKey != nil {
+				var err error
+				buf, err = adcSudpEncrypt(sudpKey, buf)
+				if err != nil {
+					dolog(LevelDebug, "[search] unable to encrypt result: %s", err)
+					return
 				}
-				conn.Write([]byte(encmsg.AdcTypeEncode(encmsg.AdcKeyEncode())))
 			}
-		}()
+			encmsgs = append(encmsgs, buf)
+		}
+		if err := c.udpWrite(peer.Ip, peer.adcUdpPort, encmsgs); err != nil {
+			dolog(LevelDebug, "[search] unable to send results: %s", err)
+		}
 
 		// send to hub
 	} else {
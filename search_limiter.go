@@ -0,0 +1,126 @@
+package dctoolkit
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// how often the buckets of idle sources are removed
+	_SEARCH_LIMITER_PRUNE_PERIOD = 1 * time.Minute
+)
+
+// SearchStats contains statistics about incoming searches.
+type SearchStats struct {
+	// searches received from peers
+	Received uint64
+	// searches that have been processed
+	Answered uint64
+	// searches dropped since their source exceeded SearchIncomingMaxPerSource
+	DroppedSourceLimit uint64
+	// searches dropped since SearchIncomingMaxTotal was exceeded
+	DroppedGlobalLimit uint64
+	// active searches dropped since results would have been sent to an IP
+	// that does not belong to the requester
+	DroppedUnknownIp uint64
+}
+
+// searchLimiterBucket is a token bucket.
+type searchLimiterBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last call.
+func (b *searchLimiterBucket) refill(now time.Time, rate float64, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// searchLimiter protects against search floods, by limiting the rate at
+// which incoming searches are processed, both for every source and globally.
+type searchLimiter struct {
+	client    *Client
+	global    searchLimiterBucket
+	sources   map[string]*searchLimiterBucket
+	lastPrune time.Time
+	stats     SearchStats
+}
+
+func newSearchLimiter(client *Client) *searchLimiter {
+	return &searchLimiter{
+		client:    client,
+		sources:   make(map[string]*searchLimiterBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow checks whether an incoming search can be processed. source identifies
+// the requester (IP, nick or session). udpIpKnown tells whether the IP to
+// which results would be sent belongs to the requester, and is always true
+// for passive searches.
+func (l *searchLimiter) allow(source string, udpIpKnown bool) error {
+	l.stats.Received++
+
+	if udpIpKnown == false {
+		l.stats.DroppedUnknownIp++
+		return fmt.Errorf("results would be sent to an unknown ip")
+	}
+
+	now := time.Now()
+	l.prune(now)
+
+	sourceRate := float64(l.client.conf.SearchIncomingMaxPerSource) / 60
+	sourceBurst := float64(l.client.conf.SearchIncomingMaxPerSource)
+	globalRate := float64(l.client.conf.SearchIncomingMaxTotal)
+	globalBurst := float64(l.client.conf.SearchIncomingMaxTotal)
+
+	b, ok := l.sources[source]
+	if !ok {
+		b = &searchLimiterBucket{}
+		l.sources[source] = b
+	}
+	b.refill(now, sourceRate, sourceBurst)
+	if b.tokens < 1 {
+		l.stats.DroppedSourceLimit++
+		return fmt.Errorf("source limit exceeded: %s", source)
+	}
+
+	l.global.refill(now, globalRate, globalBurst)
+	if l.global.tokens < 1 {
+		l.stats.DroppedGlobalLimit++
+		return fmt.Errorf("global limit exceeded")
+	}
+
+	b.tokens--
+	l.global.tokens--
+	l.stats.Answered++
+	return nil
+}
+
+// prune removes the buckets of the sources that have been idle long enough to
+// fill their bucket again.
+func (l *searchLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < _SEARCH_LIMITER_PRUNE_PERIOD {
+		return
+	}
+	l.lastPrune = now
+
+	for source, b := range l.sources {
+		if now.Sub(b.last) >= time.Minute {
+			delete(l.sources, source)
+		}
+	}
+}
+
+// SearchStats returns statistics about incoming searches.
+func (c *Client) SearchStats() SearchStats {
+	return c.searchLimiter.stats
+}
@@ -2,7 +2,6 @@ package dctoolkit
 
 import (
 	"fmt"
-	"net"
 	"strings"
 )
 
@@ -39,19 +38,16 @@ func (c *Client) handleNmdcSearchResult(isActive bool, peer *Peer, msg *msgNmdcS
 		TTH:       msg.TTH,
 		IsDir:     msg.IsDir,
 	}
-	c.handleSearchResult(sr)
+	c.handleSearchResult(sr, "")
 }
 
-func (c *Client) handleNmdcSearchOutgoingRequest(conf SearchConf) error {
-	if conf.MaxSize != 0 && conf.MinSize != 0 {
-		return fmt.Errorf("max size and min size cannot be used together in NMDC")
-	}
-
+func (c *Client) handleNmdcSearchOutgoingRequest(conf SearchConf) {
 	c.connHub.conn.Write(&msgNmdcSearchRequest{
 		Type: func() nmdcSearchType {
 			switch conf.Type {
 			case SearchAny:
-				return nmdcSearchTypeAny
+				// file types are mapped to search types 2-7
+				return nmdcSearchTypeAny + nmdcSearchType(conf.FileType)
 			case SearchDirectory:
 				return nmdcSearchTypeDirectory
 			}
@@ -70,30 +66,36 @@ func (c *Client) handleNmdcSearchOutgoingRequest(conf SearchConf) error {
 		UdpPort:  c.conf.UdpPort,
 		Nick:     c.conf.Nick,
 	})
-	return nil
 }
 
 func (c *Client) handleNmdcSearchIncomingRequest(req *msgNmdcSearchRequest) {
-	results, err := func() ([]interface{}, error) {
-		// we do not support search by type
-		if _, ok := map[nmdcSearchType]struct{}{
-			nmdcSearchTypeAny:       {},
-			nmdcSearchTypeDirectory: {},
-			nmdcSearchTypeTTH:       {},
-		}[req.Type]; !ok {
+	results, err := func() ([]searchIncomingResult, error) {
+		if req.Type < nmdcSearchTypeAny || req.Type > nmdcSearchTypeTTH {
 			return nil, fmt.Errorf("unsupported search type: %v", req.Type)
 		}
 
 		sr := &searchIncomingRequest{
+			peer: func() *Peer {
+				if req.IsActive == true {
+					return c.peerByIp(req.Ip)
+				}
+				return c.peerByNick(req.Nick)
+			}(),
 			isActive: req.IsActive,
 			stype: func() SearchType {
 				switch req.Type {
-				case nmdcSearchTypeAny:
-					return SearchAny
 				case nmdcSearchTypeDirectory:
 					return SearchDirectory
+				case nmdcSearchTypeTTH:
+					return SearchTTH
+				}
+				return SearchAny
+			}(),
+			fileType: func() FileType {
+				if req.Type >= nmdcSearchTypeAudio && req.Type <= nmdcSearchTypeVideo {
+					return FileType(req.Type - nmdcSearchTypeAny)
 				}
-				return SearchTTH
+				return FileTypeAny
 			}(),
 			minSize: req.MinSize,
 			maxSize: req.MaxSize,
@@ -111,10 +113,30 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *msgNmdcSearchRequest) {
 			}
 
 		} else {
-			sr.query = req.Query
+			sr.terms = []string{req.Query}
 		}
 
-		return c.handleSearchIncomingRequest(sr)
+		// active requests contain the ip to which results are sent: accept them
+		// only if the ip belongs to a peer, otherwise anyone could use us to
+		// flood a third party. The check is possible only if the hub sends
+		// the ips of peers ($UserIP), that usually happens only with operators
+		source := "nick:" + req.Nick
+		if req.IsActive == true {
+			source = "ip:" + req.Ip
+		}
+		dropErr := c.searchLimiter.allow(source, req.IsActive == false || func() bool {
+			if c.hubSendsPeerIps == false {
+				return c.conf.SearchIncomingIgnoreUnverifiedIps == false
+			}
+			for _, p := range c.peers {
+				if p.Ip == req.Ip {
+					return true
+				}
+			}
+			return false
+		}())
+
+		return c.handleSearchIncomingRequest(sr, dropErr)
 	}()
 	if err != nil {
 		dolog(LevelDebug, "[search] error: %s", err)
@@ -124,28 +146,15 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *msgNmdcSearchRequest) {
 	var msgs []*msgNmdcSearchResult
 	for _, res := range results {
 		msgs = append(msgs, &msgNmdcSearchResult{
-			Path: func() string {
-				if f, ok := res.(*shareFile); ok {
-					return f.aliasPath
-				}
-				return res.(*shareDirectory).aliasPath
-			}(),
-			IsDir: func() bool {
-				_, ok := res.(*shareDirectory)
-				return ok
-			}(),
+			Path:  res.path,
+			IsDir: res.isDir,
 			Size: func() uint64 {
-				if f, ok := res.(*shareFile); ok {
-					return f.size
+				if res.isDir == false {
+					return res.size
 				}
 				return 0
 			}(),
-			TTH: func() TigerHash {
-				if f, ok := res.(*shareFile); ok {
-					return f.tth
-				}
-				return TigerHash{}
-			}(),
+			TTH:       res.tth,
 			Nick:      c.conf.Nick,
 			SlotAvail: c.uploadSlotAvail,
 			SlotCount: c.conf.UploadMaxParallel,
@@ -156,17 +165,13 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *msgNmdcSearchRequest) {
 
 	// send to peer
 	if req.IsActive == true {
-		go func() {
-			conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", req.Ip, req.UdpPort))
-			if err != nil {
-				return
-			}
-			defer conn.Close()
-
-			for _, msg := range msgs {
-				conn.Write([]byte(msg.NmdcEncode()))
-			}
-		}()
+		var encmsgs [][]byte
+		for _, msg := range msgs {
+			encmsgs = append(encmsgs, []byte(msg.NmdcEncode()))
+		}
+		if err := c.udpWrite(req.Ip, req.UdpPort, encmsgs); err != nil {
+			dolog(LevelDebug, "[search] unable to send results: %s", err)
+		}
 
 		// send to hub
 	} else {
@@ -0,0 +1,152 @@
+package dctoolkit
+
+import (
+	"time"
+)
+
+// searchQueueEntry is a search waiting to be sent. Sessions started with the
+// same search share the same entry, and therefore the same token.
+type searchQueueEntry struct {
+	key      SearchConf
+	priority SearchPriority
+	token    string
+	sudpKey  []byte // ADC active mode only
+	sessions []*SearchSession
+}
+
+// searchQueueKey returns the part of a search configuration that is sent to
+// the hub, that is used to detect duplicate searches.
+func searchQueueKey(conf SearchConf) SearchConf {
+	conf.Timeout = 0
+	conf.Priority = 0
+	return conf
+}
+
+func (c *Client) searchEnqueue(s *SearchSession) {
+	key := searchQueueKey(s.conf)
+
+	// collapse duplicate searches
+	for i, e := range c.searchQueue {
+		if e.key == key {
+			e.sessions = append(e.sessions, s)
+			s.entry = e
+			s.token = e.token
+			s.sudpKey = e.sudpKey
+			if s.conf.Priority < e.priority {
+				e.priority = s.conf.Priority
+				c.searchQueue = append(c.searchQueue[:i], c.searchQueue[i+1:]...)
+				c.searchInsert(e)
+			}
+			return
+		}
+	}
+
+	e := &searchQueueEntry{
+		key:      key,
+		priority: s.conf.Priority,
+		token:    adcRandomToken(),
+		sessions: []*SearchSession{s},
+	}
+	// results are received through UDP: ask to encrypt them
+	if c.protoIsAdc == true && c.conf.IsPassive == false {
+		e.sudpKey = adcSudpKeyGenerate()
+	}
+	s.entry = e
+	s.token = e.token
+	s.sudpKey = e.sudpKey
+	c.searchInsert(e)
+	c.searchQueueProcess()
+}
+
+// searchInsert inserts an entry after the ones with the same or higher
+// priority.
+func (c *Client) searchInsert(e *searchQueueEntry) {
+	pos := len(c.searchQueue)
+	for i, other := range c.searchQueue {
+		if other.priority > e.priority {
+			pos = i
+			break
+		}
+	}
+	c.searchQueue = append(c.searchQueue, nil)
+	copy(c.searchQueue[pos+1:], c.searchQueue[pos:])
+	c.searchQueue[pos] = e
+}
+
+// searchDequeue removes a session that has been closed before its search has
+// been sent. The search is removed too if no other sessions are waiting for it.
+func (c *Client) searchDequeue(s *SearchSession) {
+	e := s.entry
+	s.entry = nil
+
+	for i, other := range e.sessions {
+		if other == s {
+			e.sessions = append(e.sessions[:i], e.sessions[i+1:]...)
+			break
+		}
+	}
+	if len(e.sessions) > 0 {
+		return
+	}
+
+	for i, other := range c.searchQueue {
+		if other == e {
+			c.searchQueue = append(c.searchQueue[:i], c.searchQueue[i+1:]...)
+			break
+		}
+	}
+}
+
+// searchNextSlot returns the time after which the next search can be sent.
+func (c *Client) searchNextSlot() time.Duration {
+	wait := time.Until(c.searchLastSent.Add(c.conf.SearchMinInterval))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (c *Client) searchEstimatedWait(e *searchQueueEntry) time.Duration {
+	for i, other := range c.searchQueue {
+		if other == e {
+			return c.searchNextSlot() + time.Duration(i)*c.conf.SearchMinInterval
+		}
+	}
+	return 0
+}
+
+// searchQueueProcess sends the first queued search, if the minimum interval
+// has elapsed, or schedules it.
+func (c *Client) searchQueueProcess() {
+	if len(c.searchQueue) == 0 || c.searchTimer != nil ||
+		c.terminateRequested == true || c.connHub.state != "initialized" {
+		return
+	}
+
+	if wait := c.searchNextSlot(); wait > 0 {
+		c.searchTimer = time.AfterFunc(wait, func() {
+			c.Safe(func() {
+				c.searchTimer = nil
+				c.searchQueueProcess()
+			})
+		})
+		return
+	}
+
+	e := c.searchQueue[0]
+	c.searchQueue = c.searchQueue[1:]
+	c.searchLastSent = time.Now()
+
+	if c.protoIsAdc == true {
+		c.handleAdcSearchOutgoingRequest(e.key, e.token, e.sudpKey)
+	} else {
+		c.handleNmdcSearchOutgoingRequest(e.key)
+	}
+
+	for _, s := range e.sessions {
+		s.start()
+	}
+
+	// schedule the next search
+	c.searchQueueProcess()
+}
@@ -0,0 +1,199 @@
+package dctoolkit
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	_SEARCH_TIMEOUT = 30 * time.Second
+)
+
+// SearchResultGroup contains the results that refer to the same file, i.e.
+// that have the same TTH. The number of sources is the number of results.
+type SearchResultGroup struct {
+	TTH     TigerHash
+	Size    uint64
+	Results []*SearchResult
+}
+
+type searchSessionKey struct {
+	peer *Peer
+	tth  TigerHash
+	path string
+}
+
+// SearchSession represents an ongoing search. The search is queued and sent
+// as soon as the hub allows it, then the session collects the results,
+// removes duplicates and groups them by TTH. It is closed automatically when
+// the timeout set in SearchConf expires.
+type SearchSession struct {
+	client  *Client
+	conf    SearchConf
+	token   string
+	sudpKey []byte
+	timer   *time.Timer
+	entry   *searchQueueEntry // set while the search is queued
+	closed  bool
+	results []*SearchResult
+	seen    map[searchSessionKey]struct{}
+	groups  map[TigerHash]*SearchResultGroup
+
+	// called every time a new result is received
+	OnResult func(sr *SearchResult)
+	// called when the session is closed
+	OnClose func()
+}
+
+// Search queues a file search, and returns a session that collects its
+// results. See SearchConf for the available options.
+func (c *Client) Search(conf SearchConf) (*SearchSession, error) {
+	if c.protoIsAdc == false && conf.MaxSize != 0 && conf.MinSize != 0 {
+		return nil, fmt.Errorf("max size and min size cannot be used together in NMDC")
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = _SEARCH_TIMEOUT
+	}
+
+	s := &SearchSession{
+		client: c,
+		conf:   conf,
+		seen:   make(map[searchSessionKey]struct{}),
+		groups: make(map[TigerHash]*SearchResultGroup),
+	}
+	c.searchSessions[s] = struct{}{}
+	c.searchEnqueue(s)
+	return s, nil
+}
+
+// Conf returns the configuration passed at startup.
+func (s *SearchSession) Conf() SearchConf {
+	return s.conf
+}
+
+// EstimatedWait returns the estimated time before the search is sent to the
+// hub, or zero if it has already been sent.
+func (s *SearchSession) EstimatedWait() time.Duration {
+	if s.entry == nil {
+		return 0
+	}
+	return s.client.searchEstimatedWait(s.entry)
+}
+
+// Results returns the results received until now, without duplicates.
+func (s *SearchSession) Results() []*SearchResult {
+	return s.results
+}
+
+// Groups returns the results received until now grouped by TTH, starting from
+// the files with the most sources. Directories are not included.
+func (s *SearchSession) Groups() []*SearchResultGroup {
+	var ret []*SearchResultGroup
+	for _, g := range s.groups {
+		ret = append(ret, g)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return len(ret[i].Results) > len(ret[j].Results)
+	})
+	return ret
+}
+
+// Close stops collecting results. It is called automatically when the
+// timeout expires.
+func (s *SearchSession) Close() {
+	if s.closed == true {
+		return
+	}
+	s.closed = true
+	if s.entry != nil {
+		s.client.searchDequeue(s)
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	delete(s.client.searchSessions, s)
+
+	if s.OnClose != nil {
+		s.OnClose()
+	}
+}
+
+// matches returns whether a result, received without token, can be an answer
+// to the search.
+func (s *SearchSession) matches(sr *SearchResult) bool {
+	switch s.conf.Type {
+	case SearchTTH:
+		return sr.IsDir == false && sr.TTH == s.conf.TTH
+
+	case SearchDirectory:
+		if sr.IsDir == false {
+			return false
+		}
+	}
+
+	// every word of the query must be contained in the path
+	lpath := strings.ToLower(sr.Path)
+	for _, word := range strings.Fields(strings.ToLower(s.conf.Query)) {
+		if strings.Contains(lpath, word) == false {
+			return false
+		}
+	}
+
+	if sr.IsDir == false {
+		if (s.conf.MinSize != 0 && sr.Size < s.conf.MinSize) ||
+			(s.conf.MaxSize != 0 && sr.Size > s.conf.MaxSize) {
+			return false
+		}
+		if s.conf.FileType != FileTypeAny {
+			ext := strings.TrimPrefix(strings.ToLower(path.Ext(sr.Path)), ".")
+			if fileTypeByExtension[ext] != s.conf.FileType {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// start is called when the search has been sent.
+func (s *SearchSession) start() {
+	s.entry = nil
+	s.timer = time.AfterFunc(s.conf.Timeout, func() {
+		s.client.Safe(func() {
+			s.Close()
+		})
+	})
+}
+
+func (s *SearchSession) handleResult(sr *SearchResult) {
+	key := searchSessionKey{peer: sr.Peer}
+	if sr.IsDir == true {
+		key.path = sr.Path
+	} else {
+		key.tth = sr.TTH
+	}
+	if _, ok := s.seen[key]; ok {
+		return
+	}
+	s.seen[key] = struct{}{}
+
+	s.results = append(s.results, sr)
+
+	if sr.IsDir == false {
+		g, ok := s.groups[sr.TTH]
+		if !ok {
+			g = &SearchResultGroup{
+				TTH:  sr.TTH,
+				Size: sr.Size,
+			}
+			s.groups[sr.TTH] = g
+		}
+		g.Results = append(g.Results, sr)
+	}
+
+	if s.OnResult != nil {
+		s.OnResult(sr)
+	}
+}
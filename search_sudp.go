@@ -0,0 +1,83 @@
+package dctoolkit
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"fmt"
+)
+
+// ADC SUDP extension: search results sent through UDP are encrypted with
+// AES-128 in CBC mode, with a zero IV, a random 16-byte prefix that replaces
+// the IV, and PKCS#5 padding. The key is sent in the KY field of the search.
+
+const (
+	_SUDP_KEY_SIZE = 16
+)
+
+func adcSudpKeyGenerate() []byte {
+	key := make([]byte, _SUDP_KEY_SIZE)
+	crand.Read(key)
+	return key
+}
+
+func adcSudpEncrypt(key []byte, msg []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padLen := aes.BlockSize - (len(msg) % aes.BlockSize)
+	data := make([]byte, aes.BlockSize+len(msg)+padLen)
+	crand.Read(data[:aes.BlockSize])
+	copy(data[aes.BlockSize:], msg)
+	for i := len(data) - padLen; i < len(data); i++ {
+		data[i] = byte(padLen)
+	}
+
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(data, data)
+	return data, nil
+}
+
+func adcSudpDecrypt(key []byte, data []byte) ([]byte, error) {
+	if len(data) < (2*aes.BlockSize) || (len(data)%aes.BlockSize) != 0 {
+		return nil, fmt.Errorf("wrong length")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plain, data)
+
+	padLen := int(plain[len(plain)-1])
+	if padLen == 0 || padLen > aes.BlockSize {
+		return nil, fmt.Errorf("wrong padding")
+	}
+	for _, b := range plain[len(plain)-padLen:] {
+		if int(b) != padLen {
+			return nil, fmt.Errorf("wrong padding")
+		}
+	}
+
+	// skip the random prefix
+	return plain[aes.BlockSize : len(plain)-padLen], nil
+}
+
+// adcSudpDecryptResult decrypts a search result with the first key that
+// produces a valid result, and returns false if the result is not encrypted
+// with any of the keys. Ciphertexts can start with any byte, therefore
+// decryption is always tried first, and fails quickly if the length is not a
+// multiple of the block size.
+func adcSudpDecryptResult(keys [][]byte, data []byte) ([]byte, bool) {
+	for _, key := range keys {
+		if plain, err := adcSudpDecrypt(key, data); err == nil &&
+			bytes.HasPrefix(plain, []byte("URES ")) {
+			return plain, true
+		}
+	}
+	return nil, false
+}
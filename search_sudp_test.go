@@ -0,0 +1,132 @@
+package dctoolkit
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+func TestSudpRoundTrip(t *testing.T) {
+	key := adcSudpKeyGenerate()
+
+	for n := 0; n <= 3*aes.BlockSize; n++ {
+		msg := bytes.Repeat([]byte{'a'}, n)
+
+		enc, err := adcSudpEncrypt(key, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// random prefix, content and at least one byte of padding
+		if expected := aes.BlockSize + (n/aes.BlockSize+1)*aes.BlockSize; len(enc) != expected {
+			t.Errorf("length %d: expected %d encrypted bytes, got %d", n, expected, len(enc))
+		}
+
+		dec, err := adcSudpDecrypt(key, enc)
+		if err != nil {
+			t.Fatalf("length %d: %s", n, err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Errorf("length %d: expected %q, got %q", n, msg, dec)
+		}
+	}
+}
+
+func TestSudpRandomPrefix(t *testing.T) {
+	key := adcSudpKeyGenerate()
+	msg := []byte("URES AAAA SItest\n")
+
+	enc1, _ := adcSudpEncrypt(key, msg)
+	enc2, _ := adcSudpEncrypt(key, msg)
+	if bytes.Equal(enc1, enc2) {
+		t.Errorf("the same message has been encrypted twice in the same way")
+	}
+}
+
+func TestSudpPadding(t *testing.T) {
+	key := adcSudpKeyGenerate()
+	block, _ := aes.NewCipher(key)
+
+	decryptRaw := func(data []byte) []byte {
+		plain := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plain, data)
+		return plain
+	}
+	encryptRaw := func(plain []byte) []byte {
+		data := make([]byte, len(plain))
+		cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(data, plain)
+		return data
+	}
+
+	// a message that fills the last block is followed by a full block of padding
+	enc, _ := adcSudpEncrypt(key, bytes.Repeat([]byte{'a'}, aes.BlockSize))
+	plain := decryptRaw(enc)
+	if !bytes.Equal(plain[2*aes.BlockSize:], bytes.Repeat([]byte{aes.BlockSize}, aes.BlockSize)) {
+		t.Errorf("wrong padding: %v", plain[2*aes.BlockSize:])
+	}
+
+	// a message of 13 bytes is followed by 3 bytes of padding
+	enc, _ = adcSudpEncrypt(key, bytes.Repeat([]byte{'a'}, 13))
+	plain = decryptRaw(enc)
+	if !bytes.Equal(plain[aes.BlockSize+13:], []byte{3, 3, 3}) {
+		t.Errorf("wrong padding: %v", plain[aes.BlockSize+13:])
+	}
+
+	// invalid padding is rejected
+	for _, ca := range []struct {
+		name string
+		tail []byte
+	}{
+		{"zero", []byte{0}},
+		{"too long", []byte{aes.BlockSize + 1}},
+		{"inconsistent", []byte{1, 2, 3, 3}},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			plain := bytes.Repeat([]byte{'a'}, 2*aes.BlockSize)
+			copy(plain[len(plain)-len(ca.tail):], ca.tail)
+			if _, err := adcSudpDecrypt(key, encryptRaw(plain)); err == nil {
+				t.Errorf("invalid padding accepted")
+			}
+		})
+	}
+}
+
+func TestSudpShortPackets(t *testing.T) {
+	key := adcSudpKeyGenerate()
+
+	for _, n := range []int{0, 1, aes.BlockSize - 1, aes.BlockSize, 2*aes.BlockSize - 1, 2*aes.BlockSize + 1} {
+		if _, err := adcSudpDecrypt(key, make([]byte, n)); err == nil {
+			t.Errorf("length %d: packet accepted", n)
+		}
+	}
+}
+
+func TestSudpDecryptResult(t *testing.T) {
+	key1 := adcSudpKeyGenerate()
+	key2 := adcSudpKeyGenerate()
+	msg := []byte("URES AAAA SItest FN/share/file.txt SL3 TO123\n")
+
+	enc, _ := adcSudpEncrypt(key2, msg)
+	plain, ok := adcSudpDecryptResult([][]byte{key1, key2}, enc)
+	if ok == false || !bytes.Equal(plain, msg) {
+		t.Errorf("encrypted result not decrypted")
+	}
+
+	// encrypted with another key
+	if _, ok := adcSudpDecryptResult([][]byte{key1}, enc); ok == true {
+		t.Errorf("result decrypted with the wrong key")
+	}
+
+	// plain results, including those whose length is a multiple of the block
+	// size, are not mistaken for encrypted ones
+	for _, n := range []int{2 * aes.BlockSize, 3 * aes.BlockSize, 4 * aes.BlockSize, 4*aes.BlockSize + 7} {
+		plainRes := append([]byte("URES AAAA FN/"), bytes.Repeat([]byte{'a'}, n-14)...)
+		plainRes = append(plainRes, '\n')
+		if len(plainRes) != n {
+			t.Fatalf("wrong length: %d", len(plainRes))
+		}
+		if _, ok := adcSudpDecryptResult([][]byte{key1, key2}, plainRes); ok == true {
+			t.Errorf("length %d: plain result mistaken for an encrypted one", n)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package dctoolkit
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// searchLinear is the reference implementation of searchShare, that walks
+// the whole tree.
+func searchLinear(c *Client, req *searchIncomingRequest, maxResults int) []interface{} {
+	req.normalize()
+	var results []interface{}
+	matches := func(apath string) bool {
+		apath = strings.ToLower(apath)
+		for _, term := range req.terms {
+			if strings.Contains(apath, term) == false {
+				return false
+			}
+		}
+		return true
+	}
+
+	var walk func(dir *shareDirectory)
+	walk = func(dir *shareDirectory) {
+		if len(results) >= maxResults {
+			return
+		}
+		if matches(dir.aliasPath) == true && req.dirMatches() == true &&
+			req.isExcluded(dir.aliasPath) == false {
+			results = append(results, dir)
+		}
+		for _, file := range dir.files {
+			if len(results) >= maxResults {
+				return
+			}
+			if matches(file.aliasPath) == true && req.fileMatches(file.aliasPath, file.size) == true {
+				results = append(results, file)
+			}
+		}
+		for _, sdir := range dir.dirs {
+			walk(sdir)
+		}
+	}
+
+	for _, dir := range c.shareTree {
+		walk(dir)
+	}
+	return results
+}
+
+func TestSearchShareMatchesLinear(t *testing.T) {
+	c := testShareClient(30, 20)
+
+	for _, ca := range []struct {
+		name string
+		req  searchIncomingRequest
+	}{
+		{"single term", searchIncomingRequest{terms: []string{"track 1-1"}}},
+		{"terms in the same name", searchIncomingRequest{terms: []string{"track", "12"}}},
+		{"terms in different names", searchIncomingRequest{terms: []string{"album 2", "-5"}}},
+		{"directory and content", searchIncomingRequest{terms: []string{"album 1"}}},
+		{"root", searchIncomingRequest{terms: []string{"share", "mp3"}}},
+		{"short term", searchIncomingRequest{terms: []string{"jpg", "7"}}},
+		{"case insensitive", searchIncomingRequest{terms: []string{"ALBUM 3", "Track"}}},
+		{"no results", searchIncomingRequest{terms: []string{"nonexistent"}}},
+		{"directories", searchIncomingRequest{stype: SearchDirectory, terms: []string{"album"}}},
+		{"excluded", searchIncomingRequest{terms: []string{"track"}, excluded: []string{"album 1"}}},
+		{"extensions", searchIncomingRequest{terms: []string{"album 2"}, extensions: []string{"mp3", "avi"}}},
+		{"extensions only", searchIncomingRequest{extensions: []string{"iso"}}},
+		{"size", searchIncomingRequest{terms: []string{"track"}, minSize: 1100, maxSize: 1200}},
+		{"file type", searchIncomingRequest{terms: []string{"track 5"}, fileType: FileTypeAudio}},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			linearReq := ca.req
+			expected := make(map[interface{}]struct{})
+			for _, res := range searchLinear(c, &linearReq, 1000000) {
+				expected[res] = struct{}{}
+			}
+
+			req := ca.req
+			results, err := c.searchShare(&req, 1000000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := make(map[interface{}]struct{})
+			for _, res := range results {
+				if _, ok := found[res]; ok {
+					t.Errorf("duplicate result: %v", res)
+				}
+				found[res] = struct{}{}
+			}
+
+			if len(found) != len(expected) {
+				t.Fatalf("expected %d results, got %d", len(expected), len(found))
+			}
+			for res := range found {
+				if _, ok := expected[res]; !ok {
+					t.Errorf("unexpected result: %v", res)
+				}
+			}
+
+			// results are limited
+			req = ca.req
+			results, _ = c.searchShare(&req, 10)
+			if max := func() int {
+				if len(expected) < 10 {
+					return len(expected)
+				}
+				return 10
+			}(); len(results) != max {
+				t.Errorf("expected %d limited results, got %d", max, len(results))
+			}
+		})
+	}
+}
+
+func TestSearchRequestHook(t *testing.T) {
+	c := testShareClient(10, 10)
+
+	for _, ca := range []struct {
+		name    string
+		dropErr error
+		results int
+	}{
+		{"answered", nil, 2},
+		{"dropped", fmt.Errorf("source limit exceeded"), 0},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			var reported *SearchRequest
+			c.OnSearchRequest = func(r *SearchRequest) {
+				reported = r
+				r.AddResult("/virtual/file.txt", false, 10, testTTH(1))
+			}
+
+			results, err := c.handleSearchIncomingRequest(&searchIncomingRequest{
+				isActive: true,
+				stype:    SearchAny,
+				terms:    []string{"track 3-4"},
+			}, ca.dropErr)
+
+			if reported == nil {
+				t.Fatal("request not reported")
+			}
+			if reported.Answered != (ca.dropErr == nil) {
+				t.Errorf("expected answered %v, got %v", ca.dropErr == nil, reported.Answered)
+			}
+			if err != ca.dropErr {
+				t.Errorf("expected error %v, got %v", ca.dropErr, err)
+			}
+			if len(results) != ca.results {
+				t.Errorf("expected %d results, got %d", ca.results, len(results))
+			}
+		})
+	}
+}
+
+var benchmarkSearchQueries = []string{"track 999-99", "album 512", "nonexistent"}
+
+func BenchmarkSearchIndexed(b *testing.B) {
+	c := testShareClient(1000, 100)
+
+	for _, query := range benchmarkSearchQueries {
+		b.Run(query, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				req := &searchIncomingRequest{
+					isActive: true,
+					stype:    SearchAny,
+					terms:    strings.Fields(query),
+				}
+				if _, err := c.handleSearchIncomingRequest(req, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSearchLinear(b *testing.B) {
+	c := testShareClient(1000, 100)
+
+	for _, query := range benchmarkSearchQueries {
+		b.Run(query, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				req := &searchIncomingRequest{
+					isActive: true,
+					stype:    SearchAny,
+					terms:    strings.Fields(query),
+				}
+				searchLinear(c, req, 10)
+			}
+		})
+	}
+}
+
+func BenchmarkSearchTTHIndexed(b *testing.B) {
+	c := testShareClient(1000, 100)
+	tth := testTTH(999*100 + 99)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		req := &searchIncomingRequest{
+			isActive: true,
+			stype:    SearchTTH,
+			tth:      tth,
+		}
+		if res, err := c.handleSearchIncomingRequest(req, nil); err != nil || len(res) != 1 {
+			b.Fatal("TTH not found")
+		}
+	}
+}
+
+func TestSearchFileMatchesSize(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		req     searchIncomingRequest
+		size    uint64
+		matches bool
+	}{
+		{"min size, smaller", searchIncomingRequest{minSize: 100}, 99, false},
+		{"min size, equal", searchIncomingRequest{minSize: 100}, 100, true},
+		{"min size, bigger", searchIncomingRequest{minSize: 100}, 101, true},
+		{"max size, smaller", searchIncomingRequest{maxSize: 200}, 199, true},
+		{"max size, equal", searchIncomingRequest{maxSize: 200}, 200, true},
+		{"max size, bigger", searchIncomingRequest{maxSize: 200}, 201, false},
+		{"exact size, smaller", searchIncomingRequest{exactSize: 150}, 149, false},
+		{"exact size, equal", searchIncomingRequest{exactSize: 150}, 150, true},
+		{"exact size, bigger", searchIncomingRequest{exactSize: 150}, 151, false},
+		{"min and max size, equal", searchIncomingRequest{minSize: 150, maxSize: 150}, 150, true},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			if v := ca.req.fileMatches("/share/file.txt", ca.size); v != ca.matches {
+				t.Errorf("expected %v, got %v", ca.matches, v)
+			}
+		})
+	}
+}
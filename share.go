@@ -2,11 +2,14 @@ package dctoolkit
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/dsnet/compress/bzip2"
 	"io"
-	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -23,26 +26,100 @@ type shareDirectory struct {
 	dirs      map[string]*shareDirectory
 	files     map[string]*shareFile
 	aliasPath string
+	diskPath  string
 	size      uint64
 }
 
+// ShareScope defines who can see a shared directory. A directory with an empty
+// scope is visible to everybody.
+type ShareScope struct {
+	// whether the directory is visible only to friends. See FriendAdd
+	FriendsOnly bool
+	// the hubs in which the directory is visible, in the same format of
+	// ClientConf.HubUrl (including the port)
+	Hubs []string
+	// the peers to which the directory is visible, identified by client ID
+	// (ADC) or by nickname (NMDC)
+	Peers []string
+}
+
+// ShareRootConf allows to configure a shared directory.
+type ShareRootConf struct {
+	// the name of the directory as seen by other peers
+	Alias string
+	// the path of the directory on disk
+	Path string
+	// who can see the directory. See ShareScope for the available options
+	Scope ShareScope
+	// rules that exclude files and directories, in addition to
+	// ClientConf.ShareExclusion. See ShareExclusion for the available options
+	Exclusion ShareExclusion
+	// whether to follow symlinks to directories. Loops are detected and skipped.
+	// Symlinks to files are always followed
+	FollowSymlinks bool
+}
+
+type shareIndexError struct {
+	path string
+	err  error
+}
+
+type shareRoot struct {
+	path           string
+	scope          ShareScope
+	exclusion      ShareExclusion
+	followSymlinks bool
+}
+
+const (
+	// the time waited after the last change of a watched directory before
+	// rescanning it, in order to avoid rescanning files that are being written
+	_SHARE_WATCH_SETTLE = 5 * time.Second
+)
+
 type shareIndexer struct {
 	client             *Client
 	terminateRequested bool
 	terminate          chan struct{}
 	indexChan          chan struct{}
 	indexRequested     bool
+	watcher            *shareWatcher
+	hasher             *shareHasher
+	// directories that contain files excluded by MinAge, and the time in which
+	// they must be rescanned to include them
+	youngDirs map[string]time.Time
 }
 
 func newshareIndexer(client *Client) error {
+	if client.conf.HashDatabasePath != "" {
+		var err error
+		client.hashDatabase, err = newHashDatabase(client.conf.HashDatabasePath)
+		if err != nil {
+			return err
+		}
+	}
+
 	client.shareIndexer = &shareIndexer{
 		client: client,
 		// must be buffered since it could otherwise cause a deadlock:
 		// - after <-indexChan and before Safe()
 		terminate: make(chan struct{}, 1),
-		indexChan: make(chan struct{}),
+		// must be buffered and written without blocking, since it is written
+		// inside Safe() while the indexer could be waiting for Safe()
+		indexChan: make(chan struct{}, 1),
+		hasher:    newShareHasher(client),
+		youngDirs: make(map[string]time.Time),
+	}
+
+	if client.conf.ShareWatch == true {
+		var err error
+		client.shareIndexer.watcher, err = newShareWatcher()
+		if err != nil {
+			return err
+		}
 	}
-	client.shareIndexer.index()
+
+	client.shareIndexer.index(true, nil)
 	return nil
 }
 
@@ -52,139 +129,712 @@ func (sm *shareIndexer) close() {
 	}
 	sm.terminateRequested = true
 	sm.terminate <- struct{}{}
+	sm.hasher.terminate()
 }
 
 func (sm *shareIndexer) do() {
 	defer sm.client.wg.Done()
 
+	var rescanChan <-chan time.Time
+	if sm.client.conf.ShareRescanInterval > 0 {
+		ticker := time.NewTicker(sm.client.conf.ShareRescanInterval)
+		defer ticker.Stop()
+		rescanChan = ticker.C
+	}
+
+	var watchChan chan string
+	if sm.watcher != nil {
+		defer sm.watcher.close()
+		watchChan = sm.watcher.events
+	}
+
+	// directories changed since the last indexing, that are rescanned
+	// once changes settle
+	dirty := make(map[string]struct{})
+	fullRescan := false
+	var settleChan <-chan time.Time
+
+	// fires when the first directory with young files must be rescanned
+	youngTimer := func() <-chan time.Time {
+		var first time.Time
+		for _, t := range sm.youngDirs {
+			if first.IsZero() || t.Before(first) {
+				first = t
+			}
+		}
+		if first.IsZero() {
+			return nil
+		}
+		return time.After(time.Until(first))
+	}
+
+	youngChan := youngTimer()
+
 	for {
 		select {
 		case <-sm.terminate:
 			return
+
 		case <-sm.indexChan:
+			sm.index(true, nil)
+
+		case <-rescanChan:
+			sm.index(false, nil)
+
+		case dpath, ok := <-watchChan:
+			// the watcher has failed: rely on periodic rescans
+			if ok == false {
+				watchChan = nil
+				continue
+			}
+
+			// events have been lost
+			if dpath == "" {
+				fullRescan = true
+			} else {
+				dirty[dpath] = struct{}{}
+			}
+			settleChan = time.After(_SHARE_WATCH_SETTLE)
+			continue
+
+		case <-settleChan:
+			if fullRescan == true {
+				sm.index(false, nil)
+			} else {
+				sm.index(false, dirty)
+			}
+
+		case <-youngChan:
+			now := time.Now()
+			for dpath, t := range sm.youngDirs {
+				if t.After(now) == false {
+					dirty[dpath] = struct{}{}
+					// the entry is added again if the directory still
+					// contains young files
+					delete(sm.youngDirs, dpath)
+				}
+			}
+			if fullRescan == true {
+				sm.index(false, nil)
+			} else {
+				sm.index(false, dirty)
+			}
 		}
 
-		sm.index()
+		// every indexing includes the pending changes
+		dirty = make(map[string]struct{})
+		fullRescan = false
+		settleChan = nil
+		youngChan = youngTimer()
 	}
 }
 
-func (sm *shareIndexer) index() {
-	copyRoots := make(map[string]string)
+func (sm *shareIndexer) getHashDatabaseEntry(realPath string, finfo os.FileInfo) *hashDatabaseEntry {
+	if sm.client.hashDatabase == nil {
+		return nil
+	}
+	return sm.client.hashDatabase.get(realPath, finfo)
+}
+
+// index scans the shared directories and publishes the new share if something
+// has changed or force is true. If dirty is not nil, only the directories it
+// contains (and the ones above them) are read from disk, while the other
+// ones are recovered from the previous indexing.
+func (sm *shareIndexer) index(force bool, dirty map[string]struct{}) {
+	copyRoots := make(map[string]shareRoot)
+	var globalExclusion ShareExclusion
 	sm.client.Safe(func() {
 		sm.indexRequested = false
 
 		// create a copy of shareRoots
 		for k, v := range sm.client.shareRoots {
-			copyRoots[k] = v
+			copyRoots[k] = *v
 		}
+		globalExclusion = sm.client.conf.ShareExclusion
 	})
 
+	startTime := time.Now()
+	report := ShareIndexReport{
+		ExcludedByReason: make(map[string]uint),
+	}
+
+	// errors are collected and reported at the end of the indexing
+	var indexErrors []shareIndexError
+	addError := func(fpath string, err error) {
+		dolog(LevelInfo, "ERR (share): %s: %s", fpath, err)
+		indexErrors = append(indexErrors, shareIndexError{fpath, err})
+	}
+
 	// generate new tree
-	shareTree, shareCount, shareSize := func() (map[string]*shareDirectory, uint, uint64) {
+	changed := false
+	terminated := false
+	shareTree := func() map[string]*shareDirectory {
 		tree := make(map[string]*shareDirectory)
-		count := uint(0)
-		size := uint64(0)
-		var scanDir func(apath string, dpath string, oldDir *shareDirectory) (*shareDirectory, error)
-		scanDir = func(apath string, dpath string, oldDir *shareDirectory) (*shareDirectory, error) {
+		var root shareRoot
+		excludesPath := func(rpath string) string {
+			if reason := globalExclusion.excludesPath(rpath); reason != "" {
+				return reason
+			}
+			return root.exclusion.excludesPath(rpath)
+		}
+		excludesFile := func(finfo os.FileInfo) string {
+			if reason := globalExclusion.excludesFile(finfo); reason != "" {
+				return reason
+			}
+			return root.exclusion.excludesFile(finfo)
+		}
+		// the time after which a file is not excluded by MinAge anymore
+		matureTime := func(finfo os.FileInfo) time.Time {
+			minAge := globalExclusion.MinAge
+			if root.exclusion.MinAge > minAge {
+				minAge = root.exclusion.MinAge
+			}
+			return finfo.ModTime().Add(minAge)
+		}
+
+		// whether a directory, or one of its subdirectories, has changed
+		isDirty := func(dpath string) bool {
+			if dirty == nil {
+				return true
+			}
+			for dirtyPath := range dirty {
+				if dirtyPath == dpath || strings.HasPrefix(dirtyPath, dpath+string(filepath.Separator)) {
+					return true
+				}
+			}
+			return false
+		}
+
+		var countDir func(dir *shareDirectory)
+		countDir = func(dir *shareDirectory) {
+			report.Dirs += uint(len(dir.dirs))
+			report.Files += uint(len(dir.files))
+			report.Size += dir.size
+			for _, sdir := range dir.dirs {
+				countDir(sdir)
+			}
+		}
+
+		// files whose TTH must be computed
+		var jobs []*shareHashJob
+
+		// identifiers of the directories that are being scanned, in order to
+		// detect loops caused by symlinks. They are made of device and inode,
+		// or of the resolved path on platforms without inodes (Windows)
+		ancestors := make(map[string]struct{})
+
+		var scanDir func(apath string, dpath string, rpath string, oldDir *shareDirectory) (*shareDirectory, bool, error)
+		scanDir = func(apath string, dpath string, rpath string, oldDir *shareDirectory) (*shareDirectory, bool, error) {
+			// recover unchanged directories from the previous indexing
+			if oldDir != nil && isDirty(dpath) == false {
+				countDir(oldDir)
+				return oldDir, false, nil
+			}
+
 			dir := &shareDirectory{
 				dirs:      make(map[string]*shareDirectory),
 				files:     make(map[string]*shareFile),
 				aliasPath: apath,
+				diskPath:  dpath,
 			}
+			changed := (oldDir == nil)
+			delete(sm.youngDirs, dpath)
 
-			files, err := ioutil.ReadDir(dpath)
+			if root.followSymlinks == true {
+				dinfo, err := os.Stat(dpath)
+				if err != nil {
+					return nil, false, err
+				}
+				id := fmt.Sprintf("%d:%d", fileDevice(dinfo), fileInode(dinfo))
+				if fileInode(dinfo) == 0 {
+					id, err = filepath.EvalSymlinks(dpath)
+					if err != nil {
+						return nil, false, err
+					}
+				}
+				if _, ok := ancestors[id]; ok {
+					return nil, false, fmt.Errorf("directory loop detected")
+				}
+				ancestors[id] = struct{}{}
+				defer delete(ancestors, id)
+			}
+
+			names, err := func() ([]string, error) {
+				f, err := os.Open(dpath)
+				if err != nil {
+					return nil, err
+				}
+				defer f.Close()
+				return f.Readdirnames(-1)
+			}()
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
-			for _, file := range files {
-				if file.IsDir() {
+			sort.Strings(names)
+
+			for _, name := range names {
+				// entries are read one by one, in order to skip the ones that
+				// cannot be accessed
+				file, err := os.Lstat(filepath.Join(dpath, name))
+				if err != nil {
+					addError(filepath.Join(dpath, name), err)
+					report.SkippedFiles++
+					continue
+				}
+
+				isDir := file.IsDir()
+				if file.Mode()&os.ModeSymlink != 0 && root.followSymlinks == true {
+					if finfo, err := os.Stat(filepath.Join(dpath, name)); err == nil && finfo.IsDir() {
+						isDir = true
+					}
+				}
+
+				frpath := path.Join(rpath, file.Name())
+				if reason := excludesPath(frpath); reason != "" {
+					if isDir == true {
+						report.ExcludedDirs++
+					} else {
+						report.ExcludedFiles++
+					}
+					report.ExcludedByReason[reason]++
+					continue
+				}
+
+				if isDir == true {
 					subOldDir := func() *shareDirectory {
 						if oldDir == nil {
 							return nil
 						}
 						return oldDir.dirs[file.Name()]
 					}()
-					subdir, err := scanDir(filepath.Join(apath, file.Name()), filepath.Join(dpath, file.Name()), subOldDir)
+					subdir, subChanged, err := scanDir(filepath.Join(apath, file.Name()), filepath.Join(dpath, file.Name()),
+						frpath, subOldDir)
 					if err != nil {
-						return nil, err
+						addError(filepath.Join(dpath, file.Name()), err)
+						report.FailedDirs++
+
+						// keep the previous directory, if available
+						if subOldDir == nil {
+							continue
+						}
+						countDir(subOldDir)
+						subdir = subOldDir
+					}
+					if subChanged == true {
+						changed = true
 					}
 					dir.dirs[file.Name()] = subdir
+					report.Dirs++
 
 				} else {
-					var tthl TigerLeaves
-					var tth TigerHash
-
 					aliasPath := filepath.Join(apath, file.Name())
 					origPath := filepath.Join(dpath, file.Name())
 
 					// solve symlinks
 					realPath, err := filepath.EvalSymlinks(origPath)
 					if err != nil {
-						return nil, err
+						addError(origPath, err)
+						report.SkippedFiles++
+						continue
 					}
 
 					// get real file info
 					var finfo os.FileInfo
 					finfo, err = os.Stat(realPath)
 					if err != nil {
-						return nil, err
+						addError(origPath, err)
+						report.SkippedFiles++
+						continue
+					}
+
+					// symlinks to directories are followed only if requested
+					if finfo.IsDir() {
+						continue
+					}
+
+					if reason := excludesFile(finfo); reason != "" {
+						report.ExcludedFiles++
+						report.ExcludedByReason[reason]++
+
+						// rescan the directory when the file is old enough
+						if reason == "age" {
+							t := matureTime(finfo)
+							if cur, ok := sm.youngDirs[dpath]; !ok || t.Before(cur) {
+								sm.youngDirs[dpath] = t
+							}
+						}
+						continue
 					}
 
 					fileSize := uint64(finfo.Size())
 					fileModTime := finfo.ModTime()
 
+					sfile := &shareFile{
+						size:      fileSize,
+						modTime:   fileModTime,
+						aliasPath: aliasPath,
+						realPath:  realPath,
+					}
+
 					// recover tth if size and mtime are the same
 					if oldDir != nil && oldDir.files[file.Name()] != nil &&
 						fileSize == oldDir.files[file.Name()].size &&
 						fileModTime.Equal(oldDir.files[file.Name()].modTime) {
-						tth = oldDir.files[file.Name()].tth
+						sfile.tth = oldDir.files[file.Name()].tth
+						sfile.tthl = oldDir.files[file.Name()].tthl
 
-					} else {
-						var err error
-						tthl, err = TTHLeavesFromFile(realPath)
-						if err != nil {
-							return nil, err
-						}
+						// recover tth from the hash database
+					} else if entry := sm.getHashDatabaseEntry(realPath, finfo); entry != nil {
+						sfile.tth = entry.TTH
+						sfile.tthl = entry.Leaves
+						changed = true
 
-						tth = tthl.TreeHash()
+						// compute tth after the scan
+					} else {
+						jobs = append(jobs, &shareHashJob{
+							file:  sfile,
+							finfo: finfo,
+							dir:   dir,
+							name:  file.Name(),
+						})
+						report.HashedFiles++
+						changed = true
 					}
 
-					dir.files[file.Name()] = &shareFile{
-						size:      fileSize,
-						modTime:   fileModTime,
-						tthl:      tthl,
-						tth:       tth,
-						aliasPath: aliasPath,
-						realPath:  realPath,
-					}
+					dir.files[file.Name()] = sfile
 					dir.size += fileSize
-					count += 1
-					size += fileSize
+					report.Files++
+					report.Size += fileSize
 				}
 			}
-			return dir, nil
+
+			// some files or directories have been removed
+			if oldDir != nil && (len(dir.dirs) != len(oldDir.dirs) || len(dir.files) != len(oldDir.files)) {
+				changed = true
+			}
+			return dir, changed, nil
 		}
-		for alias, root := range copyRoots {
+		for alias, croot := range copyRoots {
+			root = croot
 			oldDir := func() *shareDirectory {
 				if t, ok := sm.client.shareTree[alias]; ok {
 					return t
 				}
 				return nil
 			}()
-			rdir, err := scanDir("/"+alias, root, oldDir)
+			rdir, rchanged, err := scanDir("/"+alias, filepath.Clean(root.path), "", oldDir)
 			if err != nil {
-				panic(err)
+				addError(root.path, err)
+				report.FailedDirs++
+
+				// keep the previous tree, if available
+				if oldDir == nil {
+					continue
+				}
+				countDir(oldDir)
+				rdir = oldDir
+			}
+			if rchanged == true {
+				changed = true
 			}
 			tree[alias] = rdir
 		}
-		return tree, count, size
+
+		// some shared directories have been removed
+		if len(tree) != len(sm.client.shareTree) {
+			changed = true
+		}
+
+		if err := sm.hasher.hash(jobs); err != nil {
+			terminated = true
+			return nil
+		}
+
+		// remove files that could not be hashed
+		for _, job := range jobs {
+			if job.err != nil {
+				addError(job.file.realPath, job.err)
+				delete(job.dir.files, job.name)
+				job.dir.size -= job.file.size
+				report.Files--
+				report.Size -= job.file.size
+				report.HashedFiles--
+				report.FailedFiles++
+			}
+		}
+		return tree
 	}()
+	report.Duration = time.Since(startTime)
+
+	// the client has been closed while hashing
+	if terminated == true {
+		return
+	}
+
+	// build the index and the public file list only when the share is published
+	var index *shareIndex
+	var publicFileList *shareFileListJob
+	if force == true || changed == true {
+		index = newShareIndex(shareTree)
+
+		// the file list of peers that can see only public directories is
+		// generated here, in order to serve it without delays
+		var aliases []string
+		for alias := range shareTree {
+			if sm.client.shareScopeVisible(copyRoots[alias].scope, nil) == true {
+				aliases = append(aliases, alias)
+			}
+		}
+		publicFileList = sm.client.newShareFileListJob(shareTree, index, aliases)
+		if err := publicFileList.generate(); err != nil {
+			dolog(LevelInfo, "ERR (share): unable to generate file list: %s", err)
+			publicFileList = nil
+		}
+	}
+
+	if sm.watcher != nil {
+		dpaths := make(map[string]struct{})
+		var scanDir func(dir *shareDirectory)
+		scanDir = func(dir *shareDirectory) {
+			dpaths[dir.diskPath] = struct{}{}
+			for _, sdir := range dir.dirs {
+				scanDir(sdir)
+			}
+		}
+		for _, dir := range shareTree {
+			scanDir(dir)
+		}
+		sm.watcher.sync(dpaths)
+	}
+
+	// remove dead entries from the hash database, once the new share is known
+	if sm.client.hashDatabase != nil && (force == true || changed == true) {
+		keep := hashDatabaseKeep(shareTree)
+		if sm.client.hashDatabase.needsCompaction(keep) == true {
+			removed, err := sm.client.hashDatabase.compact(keep)
+			if err != nil {
+				dolog(LevelInfo, "ERR (share): unable to compact hash database: %s", err)
+			} else {
+				dolog(LevelInfo, "[share] hash database compacted automatically (%d entries removed)", removed)
+			}
+		}
+	}
+
+	sm.client.Safe(func() {
+		sm.client.shareIndexReport = report
+
+		if sm.client.OnShareIndexError != nil {
+			for _, e := range indexErrors {
+				sm.client.OnShareIndexError(e.path, e.err)
+			}
+		}
+
+		// do not publish the share if nothing has changed
+		if force == false && changed == false {
+			return
+		}
+
+		// override atomically
+		sm.client.shareTree = shareTree
+		sm.client.shareIndex = index
+		sm.client.fileLists = make(map[string][]byte)
+		if publicFileList != nil {
+			sm.client.fileLists[publicFileList.key] = publicFileList.content
+		}
+
+		// only public directories are counted
+		sm.client.shareCount = 0
+		sm.client.shareSize = 0
+		for alias, dir := range shareTree {
+			if sm.client.shareRootVisible(alias, nil) == true {
+				count, size := dir.totals()
+				sm.client.shareCount += count
+				sm.client.shareSize += size
+			}
+		}
+
+		// inform hub
+		if sm.client.connHub.terminateRequested == false && sm.client.connHub.state == "initialized" {
+			sm.client.sendInfos(false)
+		}
+
+		if sm.client.OnShareIndexed != nil {
+			sm.client.OnShareIndexed()
+		}
+	})
+}
+
+// ShareAdd adds a given directory (dpath) to the client share, with the given
+// alias, and starts indexing its subdirectories and files.
+// if a directory with the same alias was added previously, it is replaced with
+// the new one. OnShareIndexed is called when the indexing is finished.
+func (c *Client) ShareAdd(alias string, dpath string) {
+	c.ShareAddRoot(ShareRootConf{
+		Alias: alias,
+		Path:  dpath,
+	})
+}
+
+// ShareAddRoot adds a directory to the client share, with the given alias and
+// visibility scope, and starts indexing its subdirectories and files. See
+// ShareRootConf for the available options.
+// if a directory with the same alias was added previously, it is replaced with
+// the new one. OnShareIndexed is called when the indexing is finished.
+func (c *Client) ShareAddRoot(conf ShareRootConf) {
+	c.shareRoots[conf.Alias] = &shareRoot{
+		path:           conf.Path,
+		scope:          conf.Scope,
+		exclusion:      conf.Exclusion,
+		followSymlinks: conf.FollowSymlinks,
+	}
+
+	// always schedule indexing
+	if c.shareIndexer.indexRequested == false {
+		c.shareIndexer.indexRequested = true
+		select {
+		case c.shareIndexer.indexChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ShareDel removes a directory with the given alias from the client share, and
+// starts reindexing the current share.
+func (c *Client) ShareDel(alias string) {
+	if _, ok := c.shareRoots[alias]; !ok {
+		return
+	}
+
+	delete(c.shareRoots, alias)
+
+	// always schedule indexing
+	if c.shareIndexer.indexRequested == false {
+		c.shareIndexer.indexRequested = true
+		select {
+		case c.shareIndexer.indexChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// FriendAdd adds a peer to the friends, that can see the directories shared
+// with the FriendsOnly scope. Peers are identified by client ID (ADC) or by
+// nickname (NMDC).
+func (c *Client) FriendAdd(id string) {
+	c.friends[id] = struct{}{}
+}
+
+// FriendDel removes a peer from the friends.
+func (c *Client) FriendDel(id string) {
+	delete(c.friends, id)
+}
 
-	// generate new file list
+// Friends returns the identifiers of the friends.
+func (c *Client) Friends() map[string]struct{} {
+	return c.friends
+}
+
+func (d *shareDirectory) totals() (uint, uint64) {
+	count := uint(len(d.files))
+	size := d.size
+	for _, sdir := range d.dirs {
+		scount, ssize := sdir.totals()
+		count += scount
+		size += ssize
+	}
+	return count, size
+}
+
+// shareRootVisible returns whether a shared directory is visible to a peer.
+// peer is nil when the peer is unknown.
+func (c *Client) shareRootVisible(alias string, peer *Peer) bool {
+	root, ok := c.shareRoots[alias]
+	if ok == false {
+		return false
+	}
+	return c.shareScopeVisible(root.scope, peer)
+}
+
+// shareScopeVisible returns whether a shared directory with the given scope
+// is visible to a peer. If peer is nil, it does not access the client state
+// and can be called outside Safe().
+func (c *Client) shareScopeVisible(scope ShareScope, peer *Peer) bool {
+	if len(scope.Hubs) > 0 && stringInSlice(c.conf.HubUrl, scope.Hubs) == false {
+		return false
+	}
+
+	if scope.FriendsOnly == false && len(scope.Peers) == 0 {
+		return true
+	}
+	if peer == nil {
+		return false
+	}
+
+	id := c.peerIdentity(peer)
+	if scope.FriendsOnly == true {
+		if _, ok := c.friends[id]; ok {
+			return true
+		}
+	}
+	return stringInSlice(id, scope.Peers)
+}
+
+// shareFileListJob is a file list that contains some shared directories. It
+// can be generated outside Safe(), since shared trees are never modified.
+type shareFileListJob struct {
+	tree      map[string]*shareDirectory
+	index     *shareIndex // identifies the share the file list belongs to
+	aliases   []string
+	key       string
+	cid       string
+	generator string
+	content   []byte // compressed
+}
+
+func (c *Client) newShareFileListJob(tree map[string]*shareDirectory, index *shareIndex,
+	aliases []string) *shareFileListJob {
+	sort.Strings(aliases)
+	return &shareFileListJob{
+		tree:    tree,
+		index:   index,
+		aliases: aliases,
+		// file lists are cached by audience, i.e. by visible directories.
+		// aliases cannot contain slashes
+		key:       strings.Join(aliases, "/"),
+		cid:       dcBase32Encode(c.clientId),
+		generator: c.conf.ListGenerator,
+	}
+}
+
+// shareFileList returns the file list that contains the directories visible
+// to a peer. If the file list is not cached, content is nil and the file list
+// must be generated.
+func (c *Client) shareFileList(peer *Peer) *shareFileListJob {
+	var aliases []string
+	for alias := range c.shareTree {
+		if c.shareRootVisible(alias, peer) == true {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	j := c.newShareFileListJob(c.shareTree, c.shareIndex, aliases)
+	j.content = c.fileLists[j.key]
+	return j
+}
+
+// shareFileListStore caches a file list generated outside Safe(), if the
+// share has not been published again in the meanwhile.
+func (c *Client) shareFileListStore(j *shareFileListJob) {
+	if j.index == c.shareIndex {
+		c.fileLists[j.key] = j.content
+	}
+}
+
+func (j *shareFileListJob) generate() error {
 	fileList, err := func() ([]byte, error) {
 		fl := &FileList{
-			CID:       dcBase32Encode(sm.client.clientId),
-			Generator: sm.client.conf.ListGenerator,
+			CID:       j.cid,
+			Generator: j.generator,
 		}
 
 		var scanDir func(dir *shareDirectory) *FileListDirectory
@@ -204,8 +854,8 @@ func (sm *shareIndexer) index() {
 			}
 			return fd
 		}
-		for alias, dir := range shareTree {
-			fld := scanDir(dir)
+		for _, alias := range j.aliases {
+			fld := scanDir(j.tree[alias])
 			fld.Name = alias
 			fl.Dirs = append(fl.Dirs, fld)
 		}
@@ -213,11 +863,11 @@ func (sm *shareIndexer) index() {
 		return fl.Export()
 	}()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// compress file list
-	fileList, err = func() ([]byte, error) {
+	j.content, err = func() ([]byte, error) {
 		var out bytes.Buffer
 		bw, err := bzip2.NewWriter(&out, nil)
 		if err != nil {
@@ -230,54 +880,38 @@ func (sm *shareIndexer) index() {
 		bw.Close()
 		return out.Bytes(), nil
 	}()
-	if err != nil {
-		panic(err)
-	}
-
-	sm.client.Safe(func() {
-		// override atomically
-		sm.client.shareTree = shareTree
-		sm.client.fileList = fileList
-		sm.client.shareCount = shareCount
-		sm.client.shareSize = shareSize
+	return err
+}
 
-		// inform hub
-		if sm.client.connHub.terminateRequested == false && sm.client.connHub.state == "initialized" {
-			sm.client.sendInfos(false)
+// shareFilesByTTH returns the files with a given TTH that are visible to a peer.
+func (c *Client) shareFilesByTTH(tth TigerHash, peer *Peer) []*shareFile {
+	var ret []*shareFile
+	for _, id := range c.shareIndex.byTTH[tth] {
+		entry := c.shareIndex.entries[id]
+		if c.shareRootVisible(entry.alias, peer) == true {
+			ret = append(ret, entry.file)
 		}
-
-		if sm.client.OnShareIndexed != nil {
-			sm.client.OnShareIndexed()
-		}
-	})
+	}
+	return ret
 }
 
-// ShareAdd adds a given directory (dpath) to the client share, with the given
-// alias, and starts indexing its subdirectories and files.
-// if a directory with the same alias was added previously, it is replaced with
-// the new one. OnShareIndexed is called when the indexing is finished.
-func (c *Client) ShareAdd(alias string, dpath string) {
-	c.shareRoots[alias] = dpath
+func (c *Client) shareFileByAliasPath(apath string, peer *Peer) *shareFile {
+	dpath, fname := filepath.Split(apath)
+	components := strings.Split(strings.Trim(dpath, "/"), "/")
 
-	// always schedule indexing
-	if c.shareIndexer.indexRequested == false {
-		c.shareIndexer.indexRequested = true
-		c.shareIndexer.indexChan <- struct{}{}
+	if c.shareRootVisible(components[0], peer) == false {
+		return nil
 	}
-}
 
-// ShareDel removes a directory with the given alias from the client share, and
-// starts reindexing the current share.
-func (c *Client) ShareDel(alias string) {
-	if _, ok := c.shareRoots[alias]; !ok {
-		return
+	dir, ok := c.shareTree[components[0]]
+	if ok == false {
+		return nil
 	}
-
-	delete(c.shareRoots, alias)
-
-	// always schedule indexing
-	if c.shareIndexer.indexRequested == false {
-		c.shareIndexer.indexRequested = true
-		c.shareIndexer.indexChan <- struct{}{}
+	for _, name := range components[1:] {
+		dir, ok = dir.dirs[name]
+		if ok == false {
+			return nil
+		}
 	}
+	return dir.files[fname]
 }
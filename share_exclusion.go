@@ -0,0 +1,107 @@
+package dctoolkit
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ShareExclusion contains rules that exclude files and directories from the share.
+type ShareExclusion struct {
+	// glob patterns matched against the names of files and directories and
+	// against their path relative to the shared directory (i.e. *.tmp, .git, tmp/*)
+	Globs []string
+	// regular expressions matched against the path of files and directories
+	// relative to the shared directory (i.e. dir/subdir/file.txt)
+	Regexps []*regexp.Regexp
+	// skip files and directories whose name starts with a dot
+	SkipHidden bool
+	// skip files smaller than this size
+	MinSize uint64
+	// skip files bigger than this size
+	MaxSize uint64
+	// skip files modified more recently than this duration, since they could
+	// still be being written. Their directory is rescanned when they become
+	// old enough
+	MinAge time.Duration
+}
+
+// ShareIndexReport contains statistics about the last share indexing.
+type ShareIndexReport struct {
+	// the number of shared directories, files and their size
+	Dirs  uint
+	Files uint
+	Size  uint64
+	// the number of files whose TTH has been computed (the others were recovered
+	// from the previous indexing)
+	HashedFiles uint
+	// the number of files that have been skipped since they could not be
+	// accessed (i.e. broken symlinks, permission errors)
+	SkippedFiles uint
+	// the number of files whose TTH could not be computed
+	FailedFiles uint
+	// the number of directories that could not be read or that caused a
+	// loop. Their previous content, if available, is kept in the share
+	FailedDirs uint
+	// the number of excluded directories and files. When directories are
+	// rescanned because of a change, only the rescanned ones are counted
+	ExcludedDirs  uint
+	ExcludedFiles uint
+	// the number of excluded directories and files by reason (glob, regexp,
+	// hidden, size, age)
+	ExcludedByReason map[string]uint
+	// the time spent indexing
+	Duration time.Duration
+}
+
+// ShareIndexReport returns the statistics of the last share indexing.
+func (c *Client) ShareIndexReport() ShareIndexReport {
+	return c.shareIndexReport
+}
+
+// excludesPath returns the reason why a file or directory must be excluded,
+// or an empty string. rpath is the path relative to the shared directory.
+func (e *ShareExclusion) excludesPath(rpath string) string {
+	name := path.Base(rpath)
+
+	if e.SkipHidden == true && strings.HasPrefix(name, ".") {
+		return "hidden"
+	}
+
+	for _, pattern := range e.Globs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return "glob"
+		}
+		if ok, _ := path.Match(pattern, rpath); ok {
+			return "glob"
+		}
+	}
+
+	for _, re := range e.Regexps {
+		if re.MatchString(rpath) {
+			return "regexp"
+		}
+	}
+
+	return ""
+}
+
+// excludesFile returns the reason why a file must be excluded because of its
+// size or modification time, or an empty string.
+func (e *ShareExclusion) excludesFile(finfo os.FileInfo) string {
+	size := uint64(finfo.Size())
+	if size < e.MinSize {
+		return "size"
+	}
+	if e.MaxSize > 0 && size > e.MaxSize {
+		return "size"
+	}
+
+	if e.MinAge > 0 && time.Since(finfo.ModTime()) < e.MinAge {
+		return "age"
+	}
+
+	return ""
+}
@@ -0,0 +1,296 @@
+package dctoolkit
+
+import (
+	"bufio"
+	"github.com/direct-connect/go-dc/tiger"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// how often OnHashProgress is called while files are being hashed
+	_HASH_PROGRESS_PERIOD = 1 * time.Second
+	// the maximum amount of bytes read from disk at once, in order to apply the
+	// speed limit smoothly
+	_HASH_READ_CHUNK = 64 * 1024
+)
+
+// shareHashJob is a file whose TTH must be computed.
+type shareHashJob struct {
+	file  *shareFile
+	finfo os.FileInfo
+	dir   *shareDirectory
+	name  string
+	err   error
+}
+
+// shareHasher computes the TTH of shared files with a pool of workers. Hashing
+// can be paused and its disk read speed can be limited.
+type shareHasher struct {
+	client     *Client
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	paused     bool
+	terminated bool
+	// speed limit
+	limitStart time.Time
+	limitBytes uint64
+	// progress of the current run
+	curFile   string
+	doneBytes uint64
+	totBytes  uint64
+	startTime time.Time
+}
+
+func newShareHasher(client *Client) *shareHasher {
+	h := &shareHasher{
+		client: client,
+	}
+	h.cond = sync.NewCond(&h.mutex)
+	return h
+}
+
+func (h *shareHasher) terminate() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.terminated = true
+	h.cond.Broadcast()
+}
+
+func (h *shareHasher) pause() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.paused = true
+}
+
+func (h *shareHasher) resume() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.paused = false
+	h.cond.Broadcast()
+}
+
+// hash computes the TTH of the given files. Errors of single files are stored
+// in their jobs. It returns errorTerminated if the client has been closed in
+// the meanwhile.
+func (h *shareHasher) hash(jobs []*shareHashJob) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	h.mutex.Lock()
+	h.curFile = ""
+	h.doneBytes = 0
+	h.totBytes = 0
+	for _, job := range jobs {
+		h.totBytes += job.file.size
+	}
+	h.startTime = time.Now()
+	h.mutex.Unlock()
+
+	workers := int(h.client.conf.HashWorkers)
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	dolog(LevelInfo, "[share] hashing %d files with %d workers", len(jobs), workers)
+
+	var termMutex sync.Mutex
+	terminated := false
+	isTerminated := func() bool {
+		termMutex.Lock()
+		defer termMutex.Unlock()
+		return terminated
+	}
+
+	jobChan := make(chan *shareHashJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobChan {
+				if err := h.hashFile(job); err != nil {
+					if err == errorTerminated {
+						termMutex.Lock()
+						terminated = true
+						termMutex.Unlock()
+					} else {
+						job.err = err
+					}
+				}
+			}
+		}()
+	}
+
+	progressDone := make(chan struct{})
+	progressTerminated := make(chan struct{})
+	go func() {
+		defer close(progressTerminated)
+		ticker := time.NewTicker(_HASH_PROGRESS_PERIOD)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-progressDone:
+				return
+			case <-ticker.C:
+				h.progress("")
+			}
+		}
+	}()
+
+	for _, job := range jobs {
+		if isTerminated() == true {
+			break
+		}
+		jobChan <- job
+	}
+	close(jobChan)
+	wg.Wait()
+
+	close(progressDone)
+	<-progressTerminated
+
+	if isTerminated() == true {
+		return errorTerminated
+	}
+	return nil
+}
+
+func (h *shareHasher) hashFile(job *shareHashJob) error {
+	f, err := os.Open(job.file.realPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h.mutex.Lock()
+	h.curFile = job.file.realPath
+	h.mutex.Unlock()
+
+	// buffer to optimize disk read
+	buf := bufio.NewReaderSize(&shareHashReader{h, f}, 1024*1024)
+
+	leaves, err := tiger.TreeLeaves(buf)
+	if err != nil {
+		return err
+	}
+
+	tthl := TigerLeaves(leaves)
+	job.file.tth = tthl.TreeHash()
+	job.file.tthl = tthl.reduce(_TTHL_MAX_LEAVES)
+
+	if h.client.hashDatabase != nil {
+		if err := h.client.hashDatabase.set(job.file.realPath, job.finfo, job.file.tth, job.file.tthl); err != nil {
+			dolog(LevelInfo, "ERR (share): unable to write hash database: %s", err)
+		}
+	}
+
+	h.progress(job.file.realPath)
+	return nil
+}
+
+// progress calls OnHashProgress. If file is empty, the file that is currently
+// being hashed is used.
+func (h *shareHasher) progress(file string) {
+	h.mutex.Lock()
+	if file == "" {
+		file = h.curFile
+	}
+	done := h.doneBytes
+	total := h.totBytes
+	speed := func() uint64 {
+		elapsed := time.Since(h.startTime).Seconds()
+		if elapsed <= 0 {
+			return 0
+		}
+		return uint64(float64(done) / elapsed)
+	}()
+	h.mutex.Unlock()
+
+	h.client.Safe(func() {
+		if h.client.OnHashProgress != nil {
+			h.client.OnHashProgress(file, done, total, speed)
+		}
+	})
+}
+
+// wait blocks while hashing is paused.
+func (h *shareHasher) wait() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for h.paused == true && h.terminated == false {
+		h.cond.Wait()
+		// do not count the pause in the speed limit
+		h.limitStart = time.Time{}
+	}
+	if h.terminated == true {
+		return errorTerminated
+	}
+	return nil
+}
+
+// consumed counts read bytes and sleeps in order to respect the speed limit.
+func (h *shareHasher) consumed(n uint64) {
+	h.mutex.Lock()
+	h.doneBytes += n
+
+	maxSpeed := uint64(h.client.conf.HashMaxSpeed)
+	if maxSpeed == 0 {
+		h.mutex.Unlock()
+		return
+	}
+
+	// the time at which the read bytes are allowed by the limit
+	allowedAt := func() time.Time {
+		return h.limitStart.Add(time.Duration(float64(h.limitBytes) / float64(maxSpeed) * float64(time.Second)))
+	}
+
+	now := time.Now()
+
+	// the limiter has been idle: restart it, in order to avoid bursts
+	if h.limitStart.IsZero() || now.Sub(allowedAt()) > time.Second {
+		h.limitStart = now
+		h.limitBytes = 0
+	}
+
+	h.limitBytes += n
+	wait := allowedAt().Sub(now)
+	h.mutex.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type shareHashReader struct {
+	h *shareHasher
+	r io.Reader
+}
+
+func (r *shareHashReader) Read(p []byte) (int, error) {
+	if err := r.h.wait(); err != nil {
+		return 0, err
+	}
+
+	if len(p) > _HASH_READ_CHUNK {
+		p = p[:_HASH_READ_CHUNK]
+	}
+
+	n, err := r.r.Read(p)
+	r.h.consumed(uint64(n))
+	return n, err
+}
+
+// PauseHashing pauses the computation of the TTH of shared files, until
+// ResumeHashing is called. Indexing does not end while hashing is paused.
+func (c *Client) PauseHashing() {
+	c.shareIndexer.hasher.pause()
+}
+
+// ResumeHashing resumes the computation of the TTH of shared files.
+func (c *Client) ResumeHashing() {
+	c.shareIndexer.hasher.resume()
+}
@@ -0,0 +1,207 @@
+package dctoolkit
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// shareIndexEntry is a file or directory of the share.
+type shareIndexEntry struct {
+	alias string // the shared directory that contains the entry
+	name  string // lower case
+	dir   *shareDirectory
+	file  *shareFile
+	// id of the parent directory, -1 for shared directories
+	parent int
+	// the entry and its content occupy the ids in [id, end)
+	end uint32
+}
+
+// shareIndex allows to find shared files and directories without scanning the
+// whole share. It is built at the end of every indexing and never modified.
+// Ids are assigned in depth-first order, therefore the content of every
+// directory occupies a contiguous range of ids, that starts after the id of
+// the directory.
+type shareIndex struct {
+	entries []shareIndexEntry
+	// ids of the entries whose name contains a given trigram, in ascending order
+	trigrams map[string][]uint32
+	// ids of the files with a given TTH
+	byTTH map[TigerHash][]uint32
+	// ids of the files with a given extension (lower case, without dot)
+	byExtension map[string][]uint32
+	// size of directories, including subdirectories
+	dirSize map[*shareDirectory]uint64
+}
+
+func newShareIndex(tree map[string]*shareDirectory) *shareIndex {
+	idx := &shareIndex{
+		trigrams:    make(map[string][]uint32),
+		byTTH:       make(map[TigerHash][]uint32),
+		byExtension: make(map[string][]uint32),
+		dirSize:     make(map[*shareDirectory]uint64),
+	}
+
+	add := func(entry shareIndexEntry) uint32 {
+		id := uint32(len(idx.entries))
+		entry.end = id + 1
+		idx.entries = append(idx.entries, entry)
+
+		for i := 0; i+3 <= len(entry.name); i++ {
+			tri := entry.name[i : i+3]
+			list := idx.trigrams[tri]
+			// a trigram can appear multiple times in the same name
+			if len(list) > 0 && list[len(list)-1] == id {
+				continue
+			}
+			idx.trigrams[tri] = append(list, id)
+		}
+		return id
+	}
+
+	var scanDir func(alias string, name string, dir *shareDirectory, parent int) uint64
+	scanDir = func(alias string, name string, dir *shareDirectory, parent int) uint64 {
+		dirID := add(shareIndexEntry{
+			alias:  alias,
+			name:   strings.ToLower(name),
+			dir:    dir,
+			parent: parent,
+		})
+
+		for fname, file := range dir.files {
+			id := add(shareIndexEntry{
+				alias:  alias,
+				name:   strings.ToLower(fname),
+				file:   file,
+				parent: int(dirID),
+			})
+			idx.byTTH[file.tth] = append(idx.byTTH[file.tth], id)
+			if ext := strings.TrimPrefix(strings.ToLower(path.Ext(fname)), "."); ext != "" {
+				idx.byExtension[ext] = append(idx.byExtension[ext], id)
+			}
+		}
+
+		size := dir.size
+		for sname, sdir := range dir.dirs {
+			size += scanDir(alias, sname, sdir, int(dirID))
+		}
+		idx.entries[dirID].end = uint32(len(idx.entries))
+		idx.dirSize[dir] = size
+		return size
+	}
+
+	for alias, dir := range tree {
+		scanDir(alias, alias, dir, -1)
+	}
+	return idx
+}
+
+// shareIndexRange is a range of ids [start, end).
+type shareIndexRange struct {
+	start uint32
+	end   uint32
+}
+
+// candidates returns the ids of the entries whose name may contain a term,
+// i.e. the list of its rarest trigram, or nil if the term is too short.
+func (idx *shareIndex) candidates(term string) []uint32 {
+	var ret []uint32
+	for i := 0; i+3 <= len(term); i++ {
+		list := idx.trigrams[term[i:i+3]]
+		if i == 0 || len(list) < len(ret) {
+			ret = list
+		}
+	}
+	return ret
+}
+
+// restrict returns the parts of the given ranges whose paths contain a term.
+// A path contains a term if the name of the entry or the name of one of its
+// parents contains it.
+func (idx *shareIndex) restrict(ranges []shareIndexRange, term string) []shareIndexRange {
+	candidates := idx.candidates(term)
+	var ret []shareIndexRange
+
+	for _, r := range ranges {
+		// the term is contained in the first entry of the range or in one of
+		// its parents: the whole range matches
+		if func() bool {
+			for id := int(r.start); id >= 0; id = idx.entries[id].parent {
+				if strings.Contains(idx.entries[id].name, term) == true {
+					return true
+				}
+			}
+			return false
+		}() {
+			ret = append(ret, r)
+			continue
+		}
+
+		// otherwise, the range is restricted to the entries that contain the
+		// term and their content
+		add := func(id uint32) uint32 {
+			if strings.Contains(idx.entries[id].name, term) == false {
+				return id + 1
+			}
+			ret = append(ret, shareIndexRange{id, idx.entries[id].end})
+			return idx.entries[id].end
+		}
+
+		if len(term) < 3 {
+			for id := r.start + 1; id < r.end; {
+				id = add(id)
+			}
+			continue
+		}
+
+		i := sort.Search(len(candidates), func(i int) bool {
+			return candidates[i] > r.start
+		})
+		for i < len(candidates) && candidates[i] < r.end {
+			next := add(candidates[i])
+			for i < len(candidates) && candidates[i] < next {
+				i++
+			}
+		}
+	}
+	return ret
+}
+
+// match calls cb, in ascending order, for every entry whose path contains all
+// the given terms, that must be in lower case, until cb returns false. Terms
+// are resolved starting from the one with the shortest posting list, and the
+// following ones are searched only inside the ranges that matched.
+func (idx *shareIndex) match(terms []string, cb func(id uint32) bool) {
+	sorted := append([]string{}, terms...)
+	listLen := func(term string) int {
+		if len(term) < 3 {
+			return len(idx.entries)
+		}
+		return len(idx.candidates(term))
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return listLen(sorted[i]) < listLen(sorted[j])
+	})
+
+	// start from the shared directories
+	var ranges []shareIndexRange
+	for id := uint32(0); id < uint32(len(idx.entries)); id = idx.entries[id].end {
+		ranges = append(ranges, shareIndexRange{id, idx.entries[id].end})
+	}
+
+	for _, term := range sorted {
+		ranges = idx.restrict(ranges, term)
+		if len(ranges) == 0 {
+			return
+		}
+	}
+
+	for _, r := range ranges {
+		for id := r.start; id < r.end; id++ {
+			if cb(id) == false {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// +build linux
+
+package dctoolkit
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_SHARE_WATCH_MASK = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB |
+		syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	// how often the watcher checks whether it has been closed, in milliseconds
+	_SHARE_WATCH_POLL_TIMEOUT = 500
+)
+
+// shareWatcher watches shared directories through inotify, and emits the path
+// of every directory whose content has changed. An empty path means that
+// some events have been lost, and the whole share must be scanned.
+type shareWatcher struct {
+	mutex     sync.Mutex
+	fd        int
+	epfd      int
+	wds       map[int32]string
+	paths     map[string]int32
+	events    chan string
+	terminate chan struct{}
+	done      chan struct{}
+}
+
+func newShareWatcher() (*shareWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	w := &shareWatcher{
+		fd:        fd,
+		epfd:      epfd,
+		wds:       make(map[int32]string),
+		paths:     make(map[string]int32),
+		events:    make(chan string),
+		terminate: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go w.do()
+	return w, nil
+}
+
+func (w *shareWatcher) close() {
+	close(w.terminate)
+	<-w.done
+	syscall.Close(w.epfd)
+	syscall.Close(w.fd)
+}
+
+// sync replaces the watched directories with the given ones.
+func (w *shareWatcher) sync(dpaths map[string]struct{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for dpath, wd := range w.paths {
+		if _, ok := dpaths[dpath]; !ok {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.paths, dpath)
+			delete(w.wds, wd)
+		}
+	}
+
+	for dpath := range dpaths {
+		if _, ok := w.paths[dpath]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dpath, _SHARE_WATCH_MASK)
+		if err != nil {
+			dolog(LevelInfo, "ERR (share): unable to watch %s: %s", dpath, err)
+			continue
+		}
+		w.paths[dpath] = int32(wd)
+		w.wds[int32(wd)] = dpath
+	}
+}
+
+func (w *shareWatcher) do() {
+	defer close(w.done)
+	// notify the indexer that no more events will be sent
+	defer close(w.events)
+
+	buf := make([]byte, 64*1024)
+	events := make([]syscall.EpollEvent, 1)
+
+	for {
+		select {
+		case <-w.terminate:
+			return
+		default:
+		}
+
+		n, err := syscall.EpollWait(w.epfd, events, _SHARE_WATCH_POLL_TIMEOUT)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			dolog(LevelInfo, "ERR (share): watcher failed: %s", err)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+
+		n, err = syscall.Read(w.fd, buf)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			dolog(LevelInfo, "ERR (share): watcher failed: %s", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			dpath, ok := func() (string, bool) {
+				if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					return "", true
+				}
+
+				w.mutex.Lock()
+				defer w.mutex.Unlock()
+				dpath, ok := w.wds[raw.Wd]
+				// the watch has been removed by the kernel
+				if ok == true && raw.Mask&syscall.IN_IGNORED != 0 {
+					delete(w.wds, raw.Wd)
+					delete(w.paths, dpath)
+				}
+				return dpath, ok
+			}()
+			if ok == false {
+				continue
+			}
+
+			select {
+			case w.events <- dpath:
+			case <-w.terminate:
+				return
+			}
+		}
+	}
+}
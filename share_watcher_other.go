@@ -0,0 +1,21 @@
+// +build !linux
+
+package dctoolkit
+
+import (
+	"fmt"
+)
+
+type shareWatcher struct {
+	events chan string
+}
+
+func newShareWatcher() (*shareWatcher, error) {
+	return nil, fmt.Errorf("share watching is supported only on Linux")
+}
+
+func (w *shareWatcher) close() {
+}
+
+func (w *shareWatcher) sync(dpaths map[string]struct{}) {
+}
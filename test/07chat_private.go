@@ -19,7 +19,7 @@ func client1() {
 		panic(err)
 	}
 
-	client.OnMessagePrivate = func(p *dctk.Peer, content string) {
+	client.OnMessagePrivate = func(p *dctk.Peer, content string, endToEnd bool) {
 		if p.Nick == "client2" {
 			if content == "hi client1" {
 				client.MessagePrivate(p, "hi client2")
@@ -46,7 +46,7 @@ func client2() {
 		}
 	}
 
-	client.OnMessagePrivate = func(p *dctk.Peer, content string) {
+	client.OnMessagePrivate = func(p *dctk.Peer, content string, endToEnd bool) {
 		if p.Nick == "client1" {
 			if content == "hi client2" {
 				ok = true
@@ -13,6 +13,8 @@ import (
 
 var ok = false
 
+const searchMinInterval = 3 * time.Second
+
 func client1() {
 	client, err := dctk.NewClient(dctk.ClientConf{
 		HubUrl:           os.Getenv("HUBURL"),
@@ -45,33 +47,41 @@ func client1() {
 func client2() {
 	isAdc := strings.HasPrefix(os.Getenv("HUBURL"), "adc")
 	client, err := dctk.NewClient(dctk.ClientConf{
-		HubUrl:    os.Getenv("HUBURL"),
-		Nick:      "client2",
-		PrivateIp: true,
-		IsPassive: true,
+		HubUrl:            os.Getenv("HUBURL"),
+		Nick:              "client2",
+		PrivateIp:         true,
+		IsPassive:         true,
+		SearchMinInterval: searchMinInterval,
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	client.OnPeerConnected = func(p *dctk.Peer) {
-		if p.Nick == "client1" {
-			go func() {
-				time.Sleep(1 * time.Second)
-				client.Safe(func() {
-					client.Search(dctk.SearchConf{
-						Type:  dctk.SearchDirectory,
-						Query: "ner fo",
-					})
-				})
-			}()
+	// the file search is queued and waits SearchMinInterval after the directory
+	// search. Results are received through the session of every search
+	search := func() {
+		queuedAt := time.Now()
+		dirReceived := false
+
+		dirSession, err := client.Search(dctk.SearchConf{
+			Type:  dctk.SearchDirectory,
+			Query: "ner fo",
+		})
+		if err != nil {
+			panic(err)
 		}
-	}
 
-	step := 0
-	client.OnSearchResult = func(res *dctk.SearchResult) {
-		switch step {
-		case 0:
+		fileSession, err := client.Search(dctk.SearchConf{
+			Query: "test file",
+		})
+		if err != nil {
+			panic(err)
+		}
+		if fileSession.EstimatedWait() == 0 {
+			panic(fmt.Errorf("second search has not been queued"))
+		}
+
+		dirSession.OnResult = func(res *dctk.SearchResult) {
 			var zeroTTH dctk.TigerHash
 			if res.IsDir != true ||
 				res.Path != "/aliasname/inner folder" ||
@@ -81,12 +91,16 @@ func client2() {
 				res.IsActive != false {
 				panic(fmt.Errorf("wrong result (1): %+v", res))
 			}
-			step++
-			client.Search(dctk.SearchConf{
-				Query: "test file",
-			})
+			dirReceived = true
+		}
 
-		case 1:
+		fileSession.OnResult = func(res *dctk.SearchResult) {
+			if dirReceived == false {
+				panic(fmt.Errorf("second search sent before the first one"))
+			}
+			if time.Since(queuedAt) < searchMinInterval {
+				panic(fmt.Errorf("second search sent after %s", time.Since(queuedAt)))
+			}
 			if res.IsDir != false ||
 				res.Path != "/aliasname/inner folder/test file.txt" ||
 				res.TTH != dctk.TigerHashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY") ||
@@ -94,22 +108,34 @@ func client2() {
 				res.IsActive != false {
 				panic(fmt.Errorf("wrong result (2): %+v", res))
 			}
-			step++
-			client.Search(dctk.SearchConf{
+
+			tthSession, err := client.Search(dctk.SearchConf{
 				Type: dctk.SearchTTH,
 				TTH:  dctk.TigerHashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"),
 			})
-
-		case 2:
-			if res.IsDir != false ||
-				res.Path != "/aliasname/inner folder/test file.txt" ||
-				res.TTH != dctk.TigerHashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY") ||
-				res.Size != 10000 ||
-				res.IsActive != false {
-				panic(fmt.Errorf("wrong result (3): %+v", res))
+			if err != nil {
+				panic(err)
 			}
-			ok = true
-			client.Close()
+			tthSession.OnResult = func(res *dctk.SearchResult) {
+				if res.IsDir != false ||
+					res.Path != "/aliasname/inner folder/test file.txt" ||
+					res.TTH != dctk.TigerHashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY") ||
+					res.Size != 10000 ||
+					res.IsActive != false {
+					panic(fmt.Errorf("wrong result (3): %+v", res))
+				}
+				ok = true
+				client.Close()
+			}
+		}
+	}
+
+	client.OnPeerConnected = func(p *dctk.Peer) {
+		if p.Nick == "client1" {
+			go func() {
+				time.Sleep(1 * time.Second)
+				client.Safe(search)
+			}()
 		}
 	}
 
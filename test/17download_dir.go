@@ -95,7 +95,10 @@ func client2() {
 				panic(err)
 			}
 
-			client.DownloadFLDirectory(d.Conf().Peer, dir, "/tmp/out")
+			_, err = client.DownloadFLDirectory(d.Conf().Peer, dir, "/tmp/out")
+			if err != nil {
+				panic(err)
+			}
 
 		} else {
 			if _, ok := downloaded[d.Conf().TTH]; !ok {
@@ -118,11 +121,17 @@ func client2() {
 
 			count++
 			fmt.Printf("COUNT: %d\n", count)
+		}
+	}
 
-			if client.DownloadCount() == 0 {
-				client.Close()
-			}
+	client.OnDirectoryDownloadFinished = func(dd *dctk.DirectoryDownload) {
+		if dd.TotalFiles() != len(downloaded) || dd.FinishedFiles() != len(downloaded) {
+			panic("wrong file count")
+		}
+		if dd.FinishedBytes() != dd.TotalBytes() {
+			panic("wrong byte count")
 		}
+		client.Close()
 	}
 
 	client.Run()
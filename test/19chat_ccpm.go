@@ -0,0 +1,102 @@
+// +build ignore
+
+package main
+
+import (
+	dctk "github.com/gswly/dctoolkit"
+	"os"
+	"strings"
+	"time"
+)
+
+var ok = false
+
+func client1() {
+	client, err := dctk.NewClient(dctk.ClientConf{
+		HubUrl:             os.Getenv("HUBURL"),
+		Nick:               "client1",
+		PrivateIp:          true,
+		TcpPort:            3006,
+		UdpPort:            3006,
+		TcpTlsPort:         3007,
+		PeerEncryptionMode: dctk.ForceEncryption,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	client.OnMessagePrivate = func(p *dctk.Peer, content string, endToEnd bool) {
+		if p.Nick == "client2" {
+			if content == "hi client1" {
+				client.MessagePrivate(p, "hi client2")
+			}
+		}
+	}
+
+	client.Run()
+}
+
+func client2() {
+	client, err := dctk.NewClient(dctk.ClientConf{
+		HubUrl:             os.Getenv("HUBURL"),
+		Nick:               "client2",
+		PrivateIp:          true,
+		TcpPort:            3005,
+		UdpPort:            3005,
+		TcpTlsPort:         3004,
+		PeerEncryptionMode: dctk.ForceEncryption,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// in ADC, the first messages are queued while the direct connection is
+	// being established
+	isAdc := strings.HasPrefix(os.Getenv("HUBURL"), "adc")
+	done := false
+
+	client.OnPeerConnected = func(p *dctk.Peer) {
+		if p.Nick == "client1" {
+			go func() {
+				for {
+					stop := false
+					client.Safe(func() {
+						if done == true {
+							stop = true
+							return
+						}
+						client.MessagePrivate(p, "hi client1")
+					})
+					if stop == true {
+						return
+					}
+					time.Sleep(1 * time.Second)
+				}
+			}()
+		}
+	}
+
+	client.OnMessagePrivate = func(p *dctk.Peer, content string, endToEnd bool) {
+		if p.Nick == "client1" {
+			if content == "hi client2" && (endToEnd == true || isAdc == false) {
+				done = true
+				ok = true
+				client.Close()
+			}
+		}
+	}
+
+	client.Run()
+}
+
+func main() {
+	dctk.SetLogLevel(dctk.LevelInfo)
+	//dctk.SetLogLevel(dctk.LevelDebug)
+
+	go client1()
+	client2()
+
+	if ok == false {
+		panic("test failed")
+	}
+}
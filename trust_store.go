@@ -0,0 +1,98 @@
+package dctoolkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// TrustStore stores the TLS keyprints of peers, in order to detect peers that
+// change their certificate. Peers are identified by their client ID (CID) in ADC
+// and by their nickname in NMDC.
+type TrustStore interface {
+	// Keyprint returns the keyprint associated with a peer, or an empty string
+	// if the peer is unknown.
+	Keyprint(id string) string
+	// SetKeyprint associates a keyprint with a peer.
+	SetKeyprint(id string, keyprint string) error
+}
+
+// MemoryTrustStore is a TrustStore that keeps keyprints in memory.
+type MemoryTrustStore struct {
+	mutex     sync.Mutex
+	keyprints map[string]string
+}
+
+// NewMemoryTrustStore allocates a MemoryTrustStore.
+func NewMemoryTrustStore() *MemoryTrustStore {
+	return &MemoryTrustStore{
+		keyprints: make(map[string]string),
+	}
+}
+
+// Keyprint implements TrustStore.
+func (s *MemoryTrustStore) Keyprint(id string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.keyprints[id]
+}
+
+// SetKeyprint implements TrustStore.
+func (s *MemoryTrustStore) SetKeyprint(id string, keyprint string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keyprints[id] = keyprint
+	return nil
+}
+
+// FileTrustStore is a TrustStore that keeps keyprints in a JSON file, that is
+// rewritten every time a keyprint is set.
+type FileTrustStore struct {
+	mutex     sync.Mutex
+	path      string
+	keyprints map[string]string
+}
+
+// NewFileTrustStore allocates a FileTrustStore and loads the keyprints
+// from the given file, if it exists.
+func NewFileTrustStore(path string) (*FileTrustStore, error) {
+	s := &FileTrustStore{
+		path:      path,
+		keyprints: make(map[string]string),
+	}
+
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(byts, &s.keyprints); err != nil {
+		return nil, fmt.Errorf("unable to parse trust store: %s", err)
+	}
+	return s, nil
+}
+
+// Keyprint implements TrustStore.
+func (s *FileTrustStore) Keyprint(id string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.keyprints[id]
+}
+
+// SetKeyprint implements TrustStore.
+func (s *FileTrustStore) SetKeyprint(id string, keyprint string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keyprints[id] = keyprint
+
+	byts, err := json.MarshalIndent(s.keyprints, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, byts, 0644)
+}
@@ -40,6 +40,33 @@ func TTHLeavesFromFile(fpath string) (TigerLeaves, error) {
 	return TigerLeaves(ret), err
 }
 
+// reduce merges the leaves level by level, until their count is less or
+// equal than max. The resulting leaves produce the same TTH.
+func (l TigerLeaves) reduce(max int) TigerLeaves {
+	if len(l) <= max {
+		return l
+	}
+
+	lvl := append(TigerLeaves{}, l...)
+	buf := make([]byte, 2*tiger.Size+1)
+	for len(lvl) > max {
+		n := 0
+		for i := 0; i < len(lvl); i += 2 {
+			if i+1 >= len(lvl) {
+				lvl[n] = lvl[i]
+			} else {
+				buf[0] = 0x01
+				copy(buf[1:], lvl[i][:])
+				copy(buf[1+tiger.Size:], lvl[i+1][:])
+				lvl[n] = tiger.HashBytes(buf)
+			}
+			n++
+		}
+		lvl = lvl[:n]
+	}
+	return lvl
+}
+
 // TreeHash converts tiger leaves into a TTH
 func (l TigerLeaves) TreeHash() TigerHash {
 	h := tiger.Leaves(l).TreeHash()
@@ -11,30 +11,48 @@ import (
 )
 
 var errorNoSlots = fmt.Errorf("no slots available")
+var errorUploadDenied = fmt.Errorf("upload denied by policy")
+
+// uploadMethod is the command used by the peer to request a file.
+type uploadMethod int
+
+const (
+	// ADCGET (NMDC) or GET (ADC)
+	uploadMethodAdcGet uploadMethod = iota
+	// legacy NMDC $Get, that requires a $Send before sending content
+	uploadMethodGet
+	// legacy NMDC $UGetBlock
+	uploadMethodUGetBlock
+)
 
 type upload struct {
 	client             *Client
 	terminateRequested bool
 	state              string
 	pconn              *connPeer
+	method             uploadMethod
 	reader             io.ReadCloser
 	isCompressed       bool
 	query              string
 	start              uint64
 	length             uint64
+	fileSize           uint64
 	offset             uint64
 	lastPrintTime      time.Time
+	// file list that is generated before starting the upload
+	pendingFileList *shareFileListJob
 }
 
 func (*upload) isTransfer() {}
 
 func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64,
-	reqLength int64, reqCompressed bool) bool {
+	reqLength int64, reqCompressed bool, method uploadMethod) bool {
 
 	u := &upload{
 		client: client,
 		state:  "processing",
 		pconn:  pconn,
+		method: method,
 		query:  reqQuery,
 		start:  reqStart,
 		isCompressed: (client.conf.PeerDisableCompression == false &&
@@ -44,6 +62,20 @@ func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64
 	dolog(LevelInfo, "[upload] [%s] request %s (s=%d l=%d)",
 		pconn.peer.Nick, dcReadableQuery(u.query), u.start, reqLength)
 
+	var deniedReason string
+	checkPolicy := func(req *UploadRequest) error {
+		if u.client.conf.UploadPolicy == nil {
+			return nil
+		}
+		req.Peer = u.pconn.peer
+		req.Ip = u.pconn.remoteIp
+		if err := u.client.conf.UploadPolicy.AllowUpload(req); err != nil {
+			deniedReason = err.Error()
+			return errorUploadDenied
+		}
+		return nil
+	}
+
 	err := func() error {
 		// check available slots
 		if u.client.uploadSlotAvail <= 0 {
@@ -56,46 +88,69 @@ func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64
 				return fmt.Errorf("filelist seeking is not supported")
 			}
 
-			u.reader = ioutil.NopCloser(bytes.NewReader(u.client.fileList))
-			u.length = uint64(len(u.client.fileList))
+			if err := checkPolicy(&UploadRequest{IsFileList: true}); err != nil {
+				return err
+			}
+
+			fileList := u.client.shareFileList(u.pconn.peer)
+			if fileList.content != nil {
+				u.setFileList(fileList.content)
+				return nil
+			}
+
+			// the file list is not cached: generate it outside Safe(), before
+			// sending content. Legacy $Get requires the length immediately
+			if u.method != uploadMethodGet {
+				u.pendingFileList = fileList
+				return nil
+			}
+			if err := fileList.generate(); err != nil {
+				return err
+			}
+			u.client.shareFileListStore(fileList)
+			u.setFileList(fileList.content)
 			return nil
 		}
 
-		// skip "file TTH/" or "tthl TTH/"
-		tthString := u.query[9:]
+		var matches []*shareFile
 
-		// upload is file by TTH or its tthl
-		tth, err := TigerHashFromBase32(tthString)
-		if err != nil {
-			return err
-		}
+		// upload is file by path, used by legacy clients
+		if strings.HasPrefix(u.query, "file /") {
+			if sfile := u.client.shareFileByAliasPath(u.query[5:], u.pconn.peer); sfile != nil {
+				matches = []*shareFile{sfile}
+			}
 
-		sfile := func() (ret *shareFile) {
-			var scanDir func(dir *shareDirectory) bool
-			scanDir = func(dir *shareDirectory) bool {
-				for _, file := range dir.files {
-					if file.tth == tth {
-						ret = file
-						return true
-					}
-				}
-				for _, sdir := range dir.dirs {
-					if scanDir(sdir) == true {
-						return true
-					}
-				}
-				return false
+			// upload is file by TTH or its tthl
+		} else {
+			// skip "file TTH/" or "tthl TTH/"
+			tth, err := TigerHashFromBase32(u.query[9:])
+			if err != nil {
+				return err
 			}
-			for _, dir := range u.client.shareTree {
-				if scanDir(dir) == true {
-					break
-				}
+			matches = u.client.shareFilesByTTH(tth, u.pconn.peer)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("file does not exists")
+		}
+
+		// the same content can be shared in multiple directories, with
+		// different policies: serve the first one that is allowed
+		var sfile *shareFile
+		var policyErr error
+		for _, match := range matches {
+			policyErr = checkPolicy(&UploadRequest{
+				Root: strings.SplitN(strings.TrimPrefix(match.aliasPath, "/"), "/", 2)[0],
+				Path: match.aliasPath,
+			})
+			if policyErr == nil {
+				sfile = match
+				break
 			}
-			return
-		}()
+		}
 		if sfile == nil {
-			return fmt.Errorf("file does not exists")
+			return policyErr
 		}
+		u.fileSize = sfile.size
 
 		// upload is file tthl
 		if strings.HasPrefix(u.query, "tthl") {
@@ -112,8 +167,7 @@ func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64
 		}
 
 		// open file
-		var f *os.File
-		f, err = os.Open(sfile.realPath)
+		f, err := os.Open(sfile.realPath)
 		if err != nil {
 			return err
 		}
@@ -141,7 +195,12 @@ func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64
 		return nil
 	}()
 	if err != nil {
-		dolog(LevelInfo, "[peer] cannot start upload: %s", err)
+		dolog(LevelInfo, "[peer] cannot start upload: %s", func() string {
+			if err == errorUploadDenied {
+				return err.Error() + " (" + deniedReason + ")"
+			}
+			return err.Error()
+		}())
 		if err == errorNoSlots {
 			if u.client.protoIsAdc == true {
 				u.pconn.conn.Write(&msgAdcCStatus{
@@ -155,6 +214,21 @@ func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64
 			} else {
 				u.pconn.conn.Write(&msgNmdcMaxedOut{})
 			}
+		} else if err == errorUploadDenied {
+			if u.client.protoIsAdc == true {
+				u.pconn.conn.Write(&msgAdcCStatus{
+					msgAdcTypeC{},
+					msgAdcKeyStatus{
+						Type:    adcStatusWarning,
+						Code:    adcCodeTransferGeneric,
+						Message: deniedReason,
+					},
+				})
+			} else if u.method == uploadMethodUGetBlock {
+				u.pconn.conn.Write(&msgNmdcFailed{Error: deniedReason})
+			} else {
+				u.pconn.conn.Write(&msgNmdcError{Error: deniedReason})
+			}
 		} else {
 			if u.client.protoIsAdc == true {
 				u.pconn.conn.Write(&msgAdcCStatus{
@@ -165,6 +239,8 @@ func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64
 						Message: "File Not Available",
 					},
 				})
+			} else if u.method == uploadMethodUGetBlock {
+				u.pconn.conn.Write(&msgNmdcFailed{Error: "File Not Available"})
 			} else {
 				u.pconn.conn.Write(&msgNmdcError{Error: "File Not Available"})
 			}
@@ -172,7 +248,32 @@ func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64
 		return false
 	}
 
-	if u.client.protoIsAdc == true {
+	if u.pendingFileList == nil {
+		u.writeHeader()
+	}
+
+	client.transfers[u] = struct{}{}
+	u.client.uploadSlotAvail -= 1
+	u.pconn.state = "delegated_upload"
+	u.pconn.transfer = u
+	return true
+}
+
+func (u *upload) setFileList(content []byte) {
+	u.reader = ioutil.NopCloser(bytes.NewReader(content))
+	u.length = uint64(len(content))
+	u.fileSize = u.length
+}
+
+// writeHeader informs the peer that the upload is starting.
+func (u *upload) writeHeader() {
+	if u.method == uploadMethodGet {
+		u.pconn.conn.Write(&msgNmdcFileLength{Length: u.fileSize})
+
+	} else if u.method == uploadMethodUGetBlock {
+		u.pconn.conn.Write(&msgNmdcSending{Length: u.length})
+
+	} else if u.client.protoIsAdc == true {
 		u.pconn.conn.Write(&msgAdcCSendFile{
 			msgAdcTypeC{},
 			msgAdcKeySendFile{
@@ -191,12 +292,6 @@ func newUpload(client *Client, pconn *connPeer, reqQuery string, reqStart uint64
 			Compressed: u.isCompressed,
 		})
 	}
-
-	client.transfers[u] = struct{}{}
-	u.client.uploadSlotAvail -= 1
-	u.pconn.state = "delegated_upload"
-	u.pconn.transfer = u
-	return true
 }
 
 func (u *upload) Close() {
@@ -208,6 +303,17 @@ func (u *upload) Close() {
 }
 
 func (u *upload) handleUpload() error {
+	if u.pendingFileList != nil {
+		if err := u.pendingFileList.generate(); err != nil {
+			return err
+		}
+		u.client.Safe(func() {
+			u.client.shareFileListStore(u.pendingFileList)
+		})
+		u.setFileList(u.pendingFileList.content)
+		u.writeHeader()
+	}
+
 	u.pconn.conn.SetSyncMode(true)
 	if u.isCompressed == true {
 		u.pconn.conn.WriterEnableZlib()
@@ -256,7 +362,9 @@ func (u *upload) handleExit(err error) {
 
 	delete(u.client.transfers, u)
 
-	u.reader.Close()
+	if u.reader != nil {
+		u.reader.Close()
+	}
 
 	u.client.uploadSlotAvail += 1
 
@@ -0,0 +1,141 @@
+package dctoolkit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// UploadRequest contains the informations about an upload request. It is
+// passed to the UploadPolicy before a file is served.
+type UploadRequest struct {
+	// the peer that requested the upload
+	Peer *Peer
+	// the IP of the peer, as seen from the connection
+	Ip string
+	// whether the file list has been requested
+	IsFileList bool
+	// the alias of the shared directory that contains the requested file
+	// (empty if the file list has been requested)
+	Root string
+	// the path of the requested file inside the share, i.e. /alias/dir/file
+	// (empty if the file list has been requested)
+	Path string
+}
+
+// UploadPolicy decides whether an upload request can be served.
+type UploadPolicy interface {
+	// AllowUpload returns nil if the upload is allowed, otherwise an error
+	// whose message is sent back to the peer.
+	AllowUpload(req *UploadRequest) error
+}
+
+// UploadPolicyFunc allows to use a function as UploadPolicy.
+type UploadPolicyFunc func(req *UploadRequest) error
+
+// AllowUpload implements UploadPolicy.
+func (f UploadPolicyFunc) AllowUpload(req *UploadRequest) error {
+	return f(req)
+}
+
+// UploadRule is a rule of an UploadRulePolicy. A rule matches a request when
+// all its non-empty conditions are satisfied.
+type UploadRule struct {
+	// the aliases of the shared directories the rule applies to
+	Roots []string
+	// the nicknames of the peers the rule applies to
+	Nicks []string
+	// the client IDs of the peers the rule applies to, base32-encoded (ADC only)
+	ClientIds []string
+	// the IPs of the peers the rule applies to. Networks in CIDR notation
+	// (i.e. 192.168.0.0/16) are supported
+	Ips []string
+	// whether the rule applies only to operators
+	OperatorsOnly bool
+	// whether the rule applies only to peers that share at least this amount of bytes
+	MinShareSize uint64
+	// whether the rule denies the upload instead of allowing it
+	Deny bool
+	// the reason sent to the peer when the upload is denied
+	Reason string
+}
+
+// UploadRulePolicy is an UploadPolicy that applies the first rule that matches
+// a request. When no rule matches, the upload is allowed, unless DefaultDeny is true.
+type UploadRulePolicy struct {
+	Rules []UploadRule
+	// deny the upload when no rule matches
+	DefaultDeny bool
+	// the reason sent to the peer when the upload is denied by default
+	DefaultReason string
+}
+
+// AllowUpload implements UploadPolicy.
+func (rp *UploadRulePolicy) AllowUpload(req *UploadRequest) error {
+	for _, rule := range rp.Rules {
+		if rule.matches(req) == false {
+			continue
+		}
+		if rule.Deny == true {
+			return uploadDenyError(rule.Reason)
+		}
+		return nil
+	}
+
+	if rp.DefaultDeny == true {
+		return uploadDenyError(rp.DefaultReason)
+	}
+	return nil
+}
+
+func uploadDenyError(reason string) error {
+	if reason == "" {
+		reason = "Access denied"
+	}
+	return fmt.Errorf("%s", reason)
+}
+
+func (r *UploadRule) matches(req *UploadRequest) bool {
+	if len(r.Roots) > 0 && stringInSlice(req.Root, r.Roots) == false {
+		return false
+	}
+
+	if len(r.Nicks) > 0 && stringInSlice(req.Peer.Nick, r.Nicks) == false {
+		return false
+	}
+
+	if len(r.ClientIds) > 0 &&
+		stringInSlice(dcBase32Encode(req.Peer.adcClientId), r.ClientIds) == false {
+		return false
+	}
+
+	if len(r.Ips) > 0 && func() bool {
+		ip := net.ParseIP(req.Ip)
+		if ip == nil {
+			return false
+		}
+		for _, entry := range r.Ips {
+			if strings.Contains(entry, "/") {
+				_, ipnet, err := net.ParseCIDR(entry)
+				if err == nil && ipnet.Contains(ip) {
+					return true
+				}
+			} else if eip := net.ParseIP(entry); eip != nil && eip.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}() == false {
+		return false
+	}
+
+	if r.OperatorsOnly == true && req.Peer.IsOperator == false {
+		return false
+	}
+
+	if r.MinShareSize > 0 && req.Peer.ShareSize < r.MinShareSize {
+		return false
+	}
+
+	return true
+}
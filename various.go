@@ -18,8 +18,8 @@ const reStrIp = "[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}"
 const reStrPort = "[0-9]{1,5}"
 const reStrTTH = "[A-Z0-9]{39}"
 
-var reSharedCmdAdcGet = regexp.MustCompile("^((file|tthl) TTH/(" + reStrTTH + ")|file files.xml.bz2) ([0-9]+) (-1|[0-9]+)( ZL1)?$")
-var reSharedCmdAdcSnd = regexp.MustCompile("^((file|tthl) TTH/(" + reStrTTH + ")|file files.xml.bz2) ([0-9]+) ([0-9]+)( ZL1)?$")
+var reSharedCmdAdcGet = regexp.MustCompile("^((file|tthl) TTH/(" + reStrTTH + ")|file files.xml.bz2|file (/[^ ]+)) ([0-9]+) (-1|[0-9]+)( ZL1)?$")
+var reSharedCmdAdcSnd = regexp.MustCompile("^((file|tthl) TTH/(" + reStrTTH + ")|file files.xml.bz2|file (/[^ ]+)) ([0-9]+) ([0-9]+)( ZL1)?$")
 
 const dirTTH = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
 
@@ -44,6 +44,22 @@ func dcBase32Decode(in string) []byte {
 	return out
 }
 
+// queries by path contain a file name, that must be escaped like any other
+// ADC parameter, both in ADC and in NMDC (ADCGET / ADCSND)
+func dcQueryEncode(query string) string {
+	if strings.HasPrefix(query, "file /") {
+		return "file " + adcEscape(query[5:])
+	}
+	return query
+}
+
+func dcQueryDecode(matches []string) string {
+	if matches[4] != "" {
+		return "file " + adcUnescape(matches[4])
+	}
+	return matches[1]
+}
+
 func dcReadableQuery(request string) string {
 	if strings.HasPrefix(request, "tthl TTH/") {
 		return "tthl/" + strings.TrimPrefix(request, "tthl TTH/")
@@ -51,6 +67,9 @@ func dcReadableQuery(request string) string {
 	if strings.HasPrefix(request, "file TTH/") {
 		return "tth/" + strings.TrimPrefix(request, "file TTH/")
 	}
+	if strings.HasPrefix(request, "file /") {
+		return "path" + strings.TrimPrefix(request, "file ")
+	}
 	return "filelist"
 }
 
@@ -83,6 +102,15 @@ func atoi64(s string) int64 {
 	return ret
 }
 
+func stringInSlice(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 type connEstablisher struct {
 	Wait  chan struct{}
 	Conn  net.Conn